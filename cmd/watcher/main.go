@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 	"unicode"
@@ -24,6 +25,8 @@ func main() {
 	stdinPipe := flag.Bool("pipe", false, "pipe event's info to command's stdin")
 	keepalive := flag.Bool("keepalive", false, "keep alive when a cmd returns code != 0")
 	ignore := flag.String("ignore", "", "comma separated list of paths to ignore")
+	showPid := flag.Bool("show-pid", false, "show watcher's PID with each event")
+	verbose := flag.Bool("verbose", false, "show watcher's PID and a timestamp with each event")
 
 	flag.Parse()
 
@@ -39,6 +42,16 @@ func main() {
 		files = append(files, curDir)
 	}
 
+	// Resolve the files and folders now, so that whether they still exist
+	// can be told once the working directory is deleted.
+	for i, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		files[i] = abs
+	}
+
 	var cmdName string
 	var cmdArgs []string
 	if *cmd != "" {
@@ -68,6 +81,8 @@ func main() {
 		}
 	}
 
+	pid := os.Getpid()
+
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
@@ -76,7 +91,14 @@ func main() {
 			select {
 			case event := <-w.Event:
 				// Print the event's info.
-				fmt.Println(event)
+				switch {
+				case *verbose:
+					fmt.Printf("%s [%d] %s\n", time.Now().Format(time.RFC3339Nano), pid, event)
+				case *showPid:
+					fmt.Printf("[%d] %s\n", pid, event)
+				default:
+					fmt.Println(event)
+				}
 
 				// Run the command if one was specified.
 				if *cmd != "" {
@@ -99,6 +121,12 @@ func main() {
 			case err := <-w.Error:
 				if err == watcher.ErrWatchedFileDeleted {
 					fmt.Println(err)
+
+					// Exit if there's nothing left to watch.
+					if !anyExists(files) {
+						fmt.Println("all watched files and folders were deleted")
+						os.Exit(1)
+					}
 					continue
 				}
 				log.Fatalln(err)
@@ -173,3 +201,13 @@ func main() {
 
 	<-closed
 }
+
+// anyExists reports whether any of the paths exist.
+func anyExists(paths []string) bool {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
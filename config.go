@@ -0,0 +1,80 @@
+package watcher
+
+import "time"
+
+// Config describes how to set up a watcher with NewWithConfig.
+type Config struct {
+	// Interval is how often the watcher checks for changes once it's
+	// started with Start(0).
+	Interval time.Duration
+
+	// Roots are the files and directories to watch.
+	Roots []string
+
+	// Recursive sets whether the directories in Roots are watched
+	// recursively.
+	Recursive bool
+
+	// IgnoreHidden sets whether hidden files and directories are ignored.
+	IgnoreHidden bool
+
+	// IgnoreGlobs are shell file name patterns for files and directories
+	// to ignore, as understood by filepath.Match.
+	IgnoreGlobs []string
+
+	// FilterOps are the ops that events are sent for. If it's empty,
+	// events of every op are sent.
+	FilterOps []Op
+
+	// MaxEvents is the maximum number of events sent per cycle. If it's
+	// less than 1, there's no limit.
+	MaxEvents int
+}
+
+// NewWithConfig creates a new Watcher set up as described by cfg. Everything
+// is set before the roots are added, so that the roots are listed the way
+// cfg describes. It returns ErrDurationTooShort if cfg.Interval is less than
+// 1 nanosecond and ErrNothingWatched if cfg has no roots, and fails if any
+// of the patterns are malformed or any of the roots can't be added.
+func NewWithConfig(cfg Config) (*Watcher, error) {
+	if cfg.Interval < time.Nanosecond {
+		return nil, ErrDurationTooShort
+	}
+	if len(cfg.Roots) == 0 {
+		return nil, ErrNothingWatched
+	}
+
+	w := New()
+	w.interval, w.configured = cfg.Interval, cfg.Interval
+	w.IgnoreHiddenFiles(cfg.IgnoreHidden)
+	w.FilterOps(cfg.FilterOps...)
+	w.SetMaxEvents(cfg.MaxEvents)
+	if len(cfg.IgnoreGlobs) > 0 {
+		if err := w.IgnoreGlob(cfg.IgnoreGlobs...); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, root := range cfg.Roots {
+		var err error
+		if cfg.Recursive {
+			err = w.AddRecursive(root)
+		} else {
+			err = w.Add(root)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Interval returns how often the watcher checks for changes. Before it's
+// started, that's the interval set by NewWithConfig, if any.
+func (w *Watcher) Interval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.interval
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package watcher
+
+import (
+	"os"
+	"time"
+)
+
+// ctime is only supported on Linux.
+func ctime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,20 @@
+package watcher
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// ctime returns when the status of the file that info describes last
+// changed.
+func ctime(info os.FileInfo) (time.Time, bool) {
+	if info == nil {
+		return time.Time{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec)), true
+}
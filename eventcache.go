@@ -0,0 +1,50 @@
+package watcher
+
+import "container/list"
+
+// eventCache keeps the last event sent for each of the paths that most
+// recently had events, evicting the least recent ones beyond its size.
+type eventCache struct {
+	size    int
+	order   *list.List               // *cachedEvent values, most recent first.
+	entries map[string]*list.Element // elements of order by path.
+}
+
+// cachedEvent is the last event sent for path.
+type cachedEvent struct {
+	path  string
+	event Event
+}
+
+func newEventCache(size int) *eventCache {
+	return &eventCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// add makes event the last event for path.
+func (c *eventCache) add(path string, event Event) {
+	if e, found := c.entries[path]; found {
+		e.Value.(*cachedEvent).event = event
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[path] = c.order.PushFront(&cachedEvent{path: path, event: event})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedEvent).path)
+	}
+}
+
+// get returns the last event for path, if it's still cached.
+func (c *eventCache) get(path string) (Event, bool) {
+	e, found := c.entries[path]
+	if !found {
+		return Event{}, false
+	}
+	return e.Value.(*cachedEvent).event, true
+}
@@ -0,0 +1,233 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An IgnoreMatcher decides whether files or directories should be ignored.
+// Match is called with the full path of a file and whether it's a directory,
+// and returns true if the file should be ignored.
+type IgnoreMatcher interface {
+	Match(path string, isDir bool) bool
+}
+
+// patterned is implemented by the IgnoreMatchers of this package, which
+// know the patterns that they match files with.
+type patterned interface {
+	patterns() []string
+}
+
+// globMatcher ignores files that match shell file name patterns.
+type globMatcher []string
+
+// GlobIgnoreMatcher returns an IgnoreMatcher for shell file name patterns, as
+// understood by filepath.Match. A pattern is matched against both the name
+// and the full path of a file.
+func GlobIgnoreMatcher(patterns ...string) (IgnoreMatcher, error) {
+	for _, pattern := range patterns {
+		// Make sure the pattern is well formed.
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return globMatcher(patterns), nil
+}
+
+func (m globMatcher) patterns() []string {
+	return append([]string(nil), m...)
+}
+
+func (m globMatcher) Match(path string, isDir bool) bool {
+	for _, pattern := range m {
+		// Patterns are validated when created, so errors can't occur here.
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// regexMatcher ignores files that match a regular expression.
+type regexMatcher struct {
+	r           *regexp.Regexp
+	useFullPath bool
+}
+
+// RegexIgnoreMatcher returns an IgnoreMatcher that ignores files whose name,
+// or full path if useFullPath is set, matches the regular expression r.
+func RegexIgnoreMatcher(r *regexp.Regexp, useFullPath bool) IgnoreMatcher {
+	return regexMatcher{r: r, useFullPath: useFullPath}
+}
+
+func (m regexMatcher) patterns() []string {
+	return []string{m.r.String()}
+}
+
+func (m regexMatcher) Match(path string, isDir bool) bool {
+	if !m.useFullPath {
+		path = filepath.Base(path)
+	}
+	return m.r.MatchString(path)
+}
+
+// gitignoreRule is a single pattern from a .gitignore file.
+type gitignoreRule struct {
+	line    string // the line that the rule came from.
+	r       *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// gitignoreMatcher ignores files using the rules of a .gitignore file.
+type gitignoreMatcher struct {
+	root  string
+	rules []gitignoreRule
+}
+
+// GitignoreMatcher returns an IgnoreMatcher that ignores files below root in
+// the same way that git does for a .gitignore file in root made up of lines.
+func GitignoreMatcher(root string, lines ...string) IgnoreMatcher {
+	m := &gitignoreMatcher{root: root}
+	for _, line := range lines {
+		if rule, ok := parseGitignoreLine(line); ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m
+}
+
+// ReadGitignore reads the .gitignore file at path and returns an IgnoreMatcher
+// for the files below the directory that it's in.
+func ReadGitignore(path string) (IgnoreMatcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return GitignoreMatcher(filepath.Dir(path), lines...), nil
+}
+
+// parseGitignoreLine converts a line of a .gitignore file into a rule. It
+// returns false for blank lines and comments.
+func parseGitignoreLine(line string) (gitignoreRule, bool) {
+	var rule gitignoreRule
+
+	line = strings.TrimRight(line, " ")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	rule.line = line
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// Patterns with a slash are relative to the root, other patterns
+	// match at any level.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var re strings.Builder
+	if anchored {
+		re.WriteString("^")
+	} else {
+		re.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(line[i:], ']'); end > 0 {
+				class := line[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				re.WriteString("[" + class + "]")
+				i += end
+				continue
+			}
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		case c == '\\' && i+1 < len(line):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(line[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// Anything below a matching directory matches too.
+	re.WriteString("(/.*)?$")
+
+	r, err := regexp.Compile(re.String())
+	if err != nil {
+		return rule, false
+	}
+	rule.r = r
+	return rule, true
+}
+
+func (m *gitignoreMatcher) patterns() []string {
+	patterns := make([]string, 0, len(m.rules))
+	for _, rule := range m.rules {
+		patterns = append(patterns, rule.line)
+	}
+	return patterns
+}
+
+func (m *gitignoreMatcher) Match(path string, isDir bool) bool {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	// The last matching rule decides whether the file is ignored.
+	ignored := false
+	for _, rule := range m.rules {
+		match := rule.r.FindStringSubmatch(rel)
+		if match == nil {
+			continue
+		}
+		// Rules for directories only match files that are below them.
+		if rule.dirOnly && !isDir && match[1] == "" {
+			continue
+		}
+		ignored = !rule.negate
+	}
+	return ignored
+}
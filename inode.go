@@ -0,0 +1,20 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package watcher
+
+import "os"
+
+// inode is only supported on Unix systems.
+func inode(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// nlink is only supported on Unix systems.
+func nlink(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// device is only supported on Unix systems.
+func device(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
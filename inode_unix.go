@@ -0,0 +1,51 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of the file that info describes.
+func inode(info os.FileInfo) (uint64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	if c, ok := info.(*compactInfo); ok {
+		return c.ino, c.ino != 0
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+// nlink returns the number of hard links to the file that info describes.
+func nlink(info os.FileInfo) (uint64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
+
+// device returns the ID of the device that the file that info describes is
+// on.
+func device(info os.FileInfo) (uint64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	if c, ok := info.(*compactInfo); ok {
+		return c.dev, c.dev != 0
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
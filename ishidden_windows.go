@@ -3,11 +3,18 @@
 package watcher
 
 import (
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
 func isHiddenFile(path string) (bool, error) {
-	pointer, err := syscall.UTF16PtrFromString(path)
+	// Treat dot files as hidden like on other platforms.
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return true, nil
+	}
+
+	pointer, err := syscall.UTF16PtrFromString(extendedPath(path))
 	if err != nil {
 		return false, err
 	}
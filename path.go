@@ -0,0 +1,11 @@
+// +build !windows
+
+package watcher
+
+func extendedPath(path string) string {
+	return path
+}
+
+func cleanPath(path string) string {
+	return path
+}
@@ -0,0 +1,36 @@
+// +build windows
+
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	extendedPrefix    = `\\?\`
+	uncExtendedPrefix = `\\?\UNC\`
+)
+
+// extendedPath returns the extended-length form of the absolute path,
+// which allows paths longer than MAX_PATH and UNC shares to be walked.
+func extendedPath(path string) string {
+	if strings.HasPrefix(path, extendedPrefix) || !filepath.IsAbs(path) {
+		return path
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return uncExtendedPrefix + path[2:]
+	}
+	return extendedPrefix + path
+}
+
+// cleanPath reverses extendedPath.
+func cleanPath(path string) string {
+	switch {
+	case strings.HasPrefix(path, uncExtendedPrefix):
+		return `\\` + path[len(uncExtendedPrefix):]
+	case strings.HasPrefix(path, extendedPrefix):
+		return path[len(extendedPrefix):]
+	}
+	return path
+}
@@ -4,6 +4,21 @@ package watcher
 
 import "os"
 
+// rotationDetectable is whether sameFile can tell a file from one that
+// replaced it.
+const rotationDetectable = true
+
 func sameFile(fi1, fi2 os.FileInfo) bool {
-	return os.SameFile(fi1, fi2)
+	_, compact1 := fi1.(*compactInfo)
+	_, compact2 := fi2.(*compactInfo)
+	if !compact1 && !compact2 {
+		return os.SameFile(fi1, fi2)
+	}
+
+	// Compacted files only keep their inodes and devices.
+	ino1, known1 := inode(fi1)
+	ino2, known2 := inode(fi2)
+	dev1, _ := device(fi1)
+	dev2, _ := device(fi2)
+	return known1 && known2 && ino1 == ino2 && dev1 == dev2
 }
@@ -4,6 +4,12 @@ package watcher
 
 import "os"
 
+// rotationDetectable is whether sameFile can tell a file from one that
+// replaced it. The file infos that are listed here don't keep the file
+// index, so sameFile only compares what it can see, and a write would look
+// like a different file.
+const rotationDetectable = false
+
 func sameFile(fi1, fi2 os.FileInfo) bool {
 	return fi1.ModTime() == fi2.ModTime() &&
 		fi1.Size() == fi2.Size() &&
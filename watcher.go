@@ -1,15 +1,25 @@
 package watcher
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -26,6 +36,33 @@ var (
 	// being watched has been deleted.
 	ErrWatchedFileDeleted = errors.New("error: watched file or folder deleted")
 
+	// ErrPollLagging occurs when polling cycles have been taking longer than
+	// the polling interval for the number of cycles set with SetLagWarning.
+	ErrPollLagging = errors.New("error: polling cycles are taking longer than the interval")
+
+	// ErrMassChange occurs when the number of watched files changes by more
+	// than the threshold set with SetWatchSetDeltaThreshold in a single cycle,
+	// such as when switching git branches.
+	ErrMassChange = errors.New("error: number of watched files changed by more than the threshold")
+
+	// ErrNothingWatched occurs when trying to call the watcher's Start
+	// method before anything has been added, unless SetAllowEmpty was
+	// used to allow it.
+	ErrNothingWatched = errors.New("error: no files or folders are being watched")
+
+	// ErrDrift occurs when compacting the watcher's state with
+	// SetCompactInterval finds watched files that no longer exist. The
+	// changes are still found by the next polling cycle.
+	ErrDrift = errors.New("error: watched files changed since they were listed")
+
+	// ErrChecksumMismatch occurs when the contents of a file in the
+	// manifest set with SetChecksumManifest don't have the expected
+	// checksum. It's sent wrapped in a *ChecksumError.
+	ErrChecksumMismatch = errors.New("error: file checksum doesn't match the manifest")
+
+	// ErrClosed occurs when the watcher has closed.
+	ErrClosed = errors.New("error: watcher is closed")
+
 	// ErrSkip is less of an error, but more of a way for path hooks to skip a file or
 	// directory.
 	ErrSkip = errors.New("error: skipping file")
@@ -43,8 +80,18 @@ const (
 	Rename
 	Chmod
 	Move
+	DirCreate
+	DirRemove
+	Rotated
+	Attrib
+	DirEmpty
+	DirNonEmpty
+	Stale
 )
 
+// AllOps can be passed to FilterOps to stop filtering events by their op.
+const AllOps Op = ^Op(0)
+
 var ops = map[Op]string{
 	Create: "CREATE",
 	Write:  "WRITE",
@@ -52,6 +99,15 @@ var ops = map[Op]string{
 	Rename: "RENAME",
 	Chmod:  "CHMOD",
 	Move:   "MOVE",
+
+	DirCreate: "DIR_CREATE",
+	DirRemove: "DIR_REMOVE",
+	Rotated:   "ROTATED",
+	Attrib:    "ATTRIB",
+
+	DirEmpty:    "DIR_EMPTY",
+	DirNonEmpty: "DIR_NON_EMPTY",
+	Stale:       "STALE",
 }
 
 // String prints the string version of the Op consts
@@ -70,6 +126,63 @@ type Event struct {
 	Path    string
 	OldPath string
 	os.FileInfo
+
+	// Offset is the size a file had before a Write event, which is where any
+	// appended data starts. Truncated is set if the file became smaller, in
+	// which case Offset is 0. They're only set if SetTrackOffsets is enabled.
+	Offset    int64
+	Truncated bool
+
+	// Changed describes which of a file's attributes changed
+	// for Write and Chmod events.
+	Changed Changes
+
+	// Root is the path of the file or directory added to the watcher
+	// that the event's file was found under. When it was found under
+	// several, it's the longest of their paths.
+	Root string
+
+	// Inode is the inode number of the event's file. It's only set if
+	// SetTrackInodes is enabled, and on systems that have inodes.
+	Inode uint64
+
+	// Nlink is the number of hard links to the event's file, or 0 if
+	// it isn't known, such as on systems without hard link counts. If
+	// SetWatchNlink is enabled, an Attrib event is sent when it changes.
+	Nlink uint64
+
+	// EmittedAt is when the watcher sent the event, by the watcher's clock.
+	EmittedAt time.Time
+
+	// children are the paths of the files in the event's directory that
+	// changed, when events are coalesced by directory. It's a pointer so
+	// that events can still be compared with ==.
+	children *[]string
+}
+
+// Children returns the paths of the files in the event's directory that
+// changed, in the order of their events, when events are coalesced by
+// directory with SetCoalesceByDir. Otherwise it returns nil.
+func (e Event) Children() []string {
+	if e.children == nil {
+		return nil
+	}
+	return append([]string(nil), *e.children...)
+}
+
+// Age returns how long ago the event was sent by the watcher, by the
+// system's clock. The ages of events sent by a watcher that uses another
+// clock set with SetClock have to be found from that clock's time instead.
+func (e Event) Age() time.Duration {
+	return time.Since(e.EmittedAt)
+}
+
+// Changes describes which attributes of a file changed between cycles.
+type Changes struct {
+	ModTime bool
+	Size    bool
+	Mode    bool
+	Ctime   bool
 }
 
 // String returns a string depending on what type of event occurred and the
@@ -86,10 +199,110 @@ func (e Event) String() string {
 	return fmt.Sprintf("%s %q %s [%s]", pathType, e.Name(), e.Op, e.Path)
 }
 
+// Equal reports whether e and other have the same Op, Path and OldPath.
+func (e Event) Equal(other Event) bool {
+	return e.Op == other.Op && e.Path == other.Path && e.OldPath == other.OldPath
+}
+
+// opPriorities ranks ops by how much of a change to a file they describe,
+// for when only one event per file is kept. Ops that aren't listed rank
+// lowest.
+var opPriorities = map[Op]int{
+	Remove:    5,
+	DirRemove: 5,
+	Create:    4,
+	DirCreate: 4,
+	Rename:    3,
+	Move:      3,
+	Rotated:   3,
+	Write:     2,
+	Chmod:     1,
+	Attrib:    1,
+}
+
+// DedupeEvents returns the events with only one event kept for each path,
+// the one whose Op has the highest priority. From highest to lowest, the
+// priorities are removes, creates, renames, moves and rotations, writes, and
+// then everything else. When events for a path have the same priority, the
+// first one is kept. The events keep the order in which their paths first
+// appear.
+func DedupeEvents(events []Event) []Event {
+	deduped := make([]Event, 0, len(events))
+	index := make(map[string]int, len(events))
+	for _, event := range events {
+		i, found := index[event.Path]
+		if !found {
+			index[event.Path] = len(deduped)
+			deduped = append(deduped, event)
+			continue
+		}
+		if opPriorities[event.Op] > opPriorities[deduped[i].Op] {
+			deduped[i] = event
+		}
+	}
+	return deduped
+}
+
+// eventJSON is how an Event is encoded as JSON.
+type eventJSON struct {
+	Op           string     `json:"op"`
+	Path         string     `json:"path"`
+	PathBytes    []byte     `json:"pathBytes,omitempty"`
+	OldPath      string     `json:"oldPath,omitempty"`
+	OldPathBytes []byte     `json:"oldPathBytes,omitempty"`
+	Root         string     `json:"root,omitempty"`
+	Children     []string   `json:"children,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	IsDir        bool       `json:"isDir,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	ModTime      *time.Time `json:"modTime,omitempty"`
+}
+
+// MarshalJSON encodes the event as JSON. File names aren't always valid
+// UTF-8, which JSON strings have to be, so if Path or OldPath isn't, its
+// invalid bytes are replaced with U+FFFD and its raw bytes are also
+// included, base64 encoded, as pathBytes or oldPathBytes.
+func (e Event) MarshalJSON() ([]byte, error) {
+	v := eventJSON{
+		Op:       e.Op.String(),
+		Path:     e.Path,
+		OldPath:  e.OldPath,
+		Root:     e.Root,
+		Children: e.Children(),
+	}
+	if !utf8.ValidString(e.Path) {
+		v.PathBytes = []byte(e.Path)
+	}
+	if !utf8.ValidString(e.OldPath) {
+		v.OldPathBytes = []byte(e.OldPath)
+	}
+	if e.FileInfo != nil {
+		modTime := e.ModTime()
+		v.Name = e.Name()
+		v.IsDir = e.IsDir()
+		v.Size = e.Size()
+		v.ModTime = &modTime
+	}
+	return json.Marshal(v)
+}
+
 // FilterFileHookFunc is a function that is called to filter files during listings.
 // If a file is ok to be listed, nil is returned otherwise ErrSkip is returned.
 type FilterFileHookFunc func(info os.FileInfo, fullPath string) error
 
+// FilterFileRootHookFunc is like FilterFileHookFunc, but is also called with the
+// root path that was added to the watcher that the file is being listed under.
+type FilterFileRootHookFunc func(info os.FileInfo, fullPath, root string) error
+
+// FilterFileOpsHookFunc is like FilterFileHookFunc, but also returns which
+// ops events for the file are sent for when it's accepted. Accepted files
+// have events of every op sent if no ops are returned.
+type FilterFileOpsHookFunc func(info os.FileInfo, fullPath string) (accept bool, ops []Op)
+
+// EventFilterHookFunc is a function that is called to filter events before
+// they're sent. If an event is ok to be sent, true is returned.
+type EventFilterHookFunc func(e Event) bool
+
 // RegexFilterHook is a function that accepts or rejects a file
 // for listing based on whether it's filename or full path matches
 // a regular expression.
@@ -127,6 +340,250 @@ func RegexFilterHook(r *regexp.Regexp, useFullPath bool) FilterFileHookFunc {
 
 //The following additions are  available under the same license as the rest of the code.
 
+// BasenameFilterHook will return ErrSkip for files whose name isn't one of names.
+// Directories are always accepted so that matching files within them are still found.
+func BasenameFilterHook(names ...string) FilterFileHookFunc {
+	allowed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		allowed[name] = struct{}{}
+	}
+
+	return func(info os.FileInfo, fullPath string) error {
+		if info.IsDir() {
+			return nil
+		}
+		if _, found := allowed[filepath.Base(fullPath)]; found {
+			return nil
+		}
+		return ErrSkip
+	}
+}
+
+// ModeFilterHook will return ErrSkip for files whose mode doesn't satisfy predicate.
+// Directories are always accepted so that matching files within them are still found.
+func ModeFilterHook(predicate func(os.FileMode) bool) FilterFileHookFunc {
+	return func(info os.FileInfo, fullPath string) error {
+		if info.IsDir() || predicate(info.Mode()) {
+			return nil
+		}
+		return ErrSkip
+	}
+}
+
+// ModeEventFilterHook accepts events whose file's mode satisfies predicate. Used together
+// with FilterOps(Chmod), it only lets through the mode changes that predicate is interested in.
+func ModeEventFilterHook(predicate func(os.FileMode) bool) EventFilterHookFunc {
+	return func(e Event) bool {
+		return e.FileInfo != nil && predicate(e.Mode())
+	}
+}
+
+// ContentTypeFilterHook will return ErrSkip for files whose content type, as
+// sniffed from their first 512 bytes by http.DetectContentType, isn't one of
+// types. A type matches if it's the same as the sniffed type with or without
+// its parameters, such as "text/plain", or if it ends with a slash and the
+// sniffed type starts with it, such as "image/". A file is only sniffed again
+// if its size or modification time changes, and files that can't be read are
+// skipped. What's remembered about a file is forgotten once a watcher sees it,
+// or the directory it's in, removed, or sees that directory written to after
+// the file is gone. Directories are always accepted so that matching files
+// within them are still found.
+func ContentTypeFilterHook(types ...string) FilterFileHookFunc {
+	h := &sniffHook{cache: newSniffCache()}
+	runtime.SetFinalizer(h, func(h *sniffHook) { h.cache.unregister() })
+
+	matches := func(contentType string) bool {
+		mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+		for _, t := range types {
+			if t == contentType || t == mediaType ||
+				strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(info os.FileInfo, fullPath string) error {
+		if info.IsDir() {
+			return nil
+		}
+
+		s, found := h.cache.get(fullPath)
+		if !found || s.size != info.Size() || !s.modTime.Equal(info.ModTime()) {
+			f, err := os.Open(extendedPath(fullPath))
+			if err != nil {
+				return ErrSkip
+			}
+			head := make([]byte, 512)
+			n, err := io.ReadFull(f, head)
+			f.Close()
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return ErrSkip
+			}
+
+			s = sniffed{
+				size:    info.Size(),
+				modTime: info.ModTime(),
+				matched: matches(http.DetectContentType(head[:n])),
+			}
+			h.cache.put(fullPath, s)
+		}
+
+		if s.matched {
+			return nil
+		}
+		return ErrSkip
+	}
+}
+
+// A sniffHook is held by a hook made by ContentTypeFilterHook for as long
+// as the hook is in use, so that its cache stops being kept up to date
+// once the hook is gone.
+type sniffHook struct {
+	cache *sniffCache
+}
+
+// sniffed is what ContentTypeFilterHook remembers about a file.
+type sniffed struct {
+	size    int64
+	modTime time.Time
+	matched bool
+}
+
+// A sniffCache is what a hook made by ContentTypeFilterHook remembers about
+// the files in each directory.
+type sniffCache struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]sniffed
+}
+
+// sniffCaches are the sniffCaches of the hooks that are in use, which
+// watchers make forget the files that they see removed.
+var sniffCaches = struct {
+	sync.Mutex
+	caches map[*sniffCache]struct{}
+}{caches: make(map[*sniffCache]struct{})}
+
+// newSniffCache returns an empty sniffCache that's kept up to date.
+func newSniffCache() *sniffCache {
+	c := &sniffCache{dirs: make(map[string]map[string]sniffed)}
+	sniffCaches.Lock()
+	sniffCaches.caches[c] = struct{}{}
+	sniffCaches.Unlock()
+	return c
+}
+
+// unregister stops c from being kept up to date.
+func (c *sniffCache) unregister() {
+	sniffCaches.Lock()
+	delete(sniffCaches.caches, c)
+	sniffCaches.Unlock()
+}
+
+func (c *sniffCache) get(path string) (sniffed, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, found := c.dirs[filepath.Dir(path)][filepath.Base(path)]
+	return s, found
+}
+
+func (c *sniffCache) put(path string, s sniffed) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := filepath.Dir(path)
+	files, found := c.dirs[dir]
+	if !found {
+		files = make(map[string]sniffed)
+		c.dirs[dir] = files
+	}
+	files[filepath.Base(path)] = s
+}
+
+// save saves what c remembers about path, and returns a function that puts
+// it back.
+func (c *sniffCache) save(path string) func() {
+	s, found := c.get(path)
+	return func() {
+		if found {
+			c.put(path, s)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		dir := filepath.Dir(path)
+		if files, ok := c.dirs[dir]; ok {
+			delete(files, filepath.Base(path))
+			if len(files) == 0 {
+				delete(c.dirs, dir)
+			}
+		}
+	}
+}
+
+// forget forgets the files that event shows are gone: the removed or moved
+// file and anything below it, or, for a Write event of a directory, the
+// files that are no longer in it.
+func (c *sniffCache) forget(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	isDir := event.FileInfo != nil && event.IsDir()
+	switch event.Op {
+	case Remove:
+		c.forgetTree(event.Path, isDir)
+	case Rename, Move:
+		c.forgetTree(event.OldPath, isDir)
+	case Write:
+		if !isDir {
+			return
+		}
+		files := c.dirs[event.Path]
+		for name := range files {
+			if _, err := os.Lstat(extendedPath(filepath.Join(event.Path, name))); os.IsNotExist(err) {
+				delete(files, name)
+			}
+		}
+		if len(files) == 0 {
+			delete(c.dirs, event.Path)
+		}
+	}
+}
+
+// forgetTree forgets path, and everything below it if it's a directory.
+func (c *sniffCache) forgetTree(path string, isDir bool) {
+	dir := filepath.Dir(path)
+	if files, found := c.dirs[dir]; found {
+		delete(files, filepath.Base(path))
+		if len(files) == 0 {
+			delete(c.dirs, dir)
+		}
+	}
+	if !isDir {
+		return
+	}
+	for dir := range c.dirs {
+		if dir == path || isUnder(dir, path) {
+			delete(c.dirs, dir)
+		}
+	}
+}
+
+// forgetSniffed makes the hooks made by ContentTypeFilterHook forget the
+// files that events show are gone.
+func forgetSniffed(events []Event) {
+	sniffCaches.Lock()
+	defer sniffCaches.Unlock()
+
+	for c := range sniffCaches.caches {
+		for _, event := range events {
+			c.forget(event)
+		}
+	}
+}
+
 // NoDirectoryFilterHook will return ErrSkip if this is a directory
 func NoDirectoryFilterHook() FilterFileHookFunc {
 	return func(info os.FileInfo, fullPath string) error {
@@ -162,6 +619,23 @@ func NegativeFilterHook(r *regexp.Regexp, useFullPath bool) FilterFileHookFunc {
 	}
 }
 
+// FileWatcher is the interface implemented by Watcher. Code that depends on
+// FileWatcher instead of *Watcher can be given a fake watcher in tests.
+type FileWatcher interface {
+	Add(name string) error
+	AddRecursive(name string) error
+	Remove(name string) error
+	Ignore(paths ...string) error
+	Start(d time.Duration) error
+	Close()
+	Wait()
+	Events() <-chan Event
+	Errors() <-chan error
+	Done() <-chan struct{}
+}
+
+var _ FileWatcher = (*Watcher)(nil)
+
 // Watcher describes a process that watches files for changes.
 type Watcher struct {
 	Event  chan Event
@@ -172,14 +646,153 @@ type Watcher struct {
 
 	// mu protects the following.
 	mu           *sync.Mutex
-	ffh          []FilterFileHookFunc
+	ffh          []FilterFileRootHookFunc
+	rootHooks    bool // whether any of ffh use their root.
+	efh          []EventFilterHookFunc
+	opsHooks     []*opsHook // filter hooks that also limit ops.
+	transformer  func(Event) (Event, bool)
+	rewrite      *regexp.Regexp // pattern of paths to rewrite.
+	replacement  string         // replacement for rewritten paths.
+	slashPaths   bool           // use forward slashes in event paths.
 	running      bool
 	names        map[string]bool        // bool for recursive or not.
+	depths       map[string]int         // depth limits of recursive names.
+	shallow      map[string]struct{}    // names only watched for entries changing.
 	files        map[string]os.FileInfo // map of files.
 	ignored      map[string]struct{}    // ignored files or directories.
-	ops          map[Op]struct{}        // Op filtering.
+	matchers     []IgnoreMatcher        // matchers for ignored files.
+	pruned       map[string]struct{}    // new directories that aren't descended into.
+	ops          map[Op]struct{}        // Op filtering, nil for none.
 	ignoreHidden bool                   // ignore hidden files or not.
 	maxEvents    int                    // max sent events per cycle
+	queue        []Event                // events waiting to be sent this cycle
+	deferred     []Event                // events waiting for a later cycle
+
+	maxEventsPerCycle int      // max sent events per cycle, deferring the rest.
+	restrictAutoWatch bool     // restrict auto-watching new directories.
+	autoWatchDirs     []string // parents of auto-watched new directories.
+	lagWarning        int      // lagging cycles before warning.
+	lagCycles         int      // current lagging cycles in a row.
+
+	collapseCreateWrite bool              // drop writes of files created in the same cycle.
+	aliases             map[string]string // canonical paths of aliased paths.
+	distinctDirOps      bool              // use DirCreate and DirRemove for directories.
+	watchAccessibility  bool              // send chmods when files become (un)readable.
+	readable            map[string]bool   // whether files could be read last cycle.
+
+	followed     map[string]struct{} // files that are followed when rotated.
+	trackOffsets bool                // set the offsets of write events.
+	strictChmod  bool                // only send chmods for permission changes.
+
+	moveSizeTolerance int64         // size difference allowed when pairing moves.
+	modTimeResolution time.Duration // what modification times are truncated to.
+
+	watchXattrs bool              // send attribs when extended attributes change.
+	xattrs      map[string]string // extended attributes of files last cycle.
+
+	watchNlink bool // send attribs when the number of hard links changes.
+
+	watchDirEmptiness bool           // send events when directories become (non-)empty.
+	dirEntries        map[string]int // entries of directories last cycle.
+
+	stableDelay time.Duration            // hold back events until files stop changing.
+	unstable    map[string]*unstableFile // files whose events are held back.
+
+	clock        Clock         // source of time.
+	idleTimeout  time.Duration // close after no events for this long.
+	lastActivity time.Time     // time of the last sent event.
+
+	maxRunTime time.Duration    // close after running for this long.
+	expired    <-chan time.Time // receives once the max run time has passed.
+
+	countTriggers map[string]*countTrigger // paths whose writes are only sent every nth time.
+	suppressed    map[string]struct{}      // paths whose next write isn't sent.
+
+	matching map[string]matching // names whose files have to match a pattern.
+
+	emitRemoveOnClose bool    // send removes for all the files when closing.
+	closing           []Event // removes left to send when closing.
+
+	compactInterval time.Duration // how often the watcher's state is compacted.
+	nextCompact     time.Time     // when the watcher's state is next compacted.
+
+	trackInodes bool // send creates for files replaced by other files.
+
+	useCtime bool // send writes for files whose ctime changes.
+
+	sameFilesystemOnly bool // don't descend into other filesystems.
+
+	dirGate string // name of the files that stop their directories being watched.
+
+	compactState bool // only keep the metadata that changes are found with.
+
+	windowStart, windowEnd time.Duration          // times of day that events are sent between.
+	closedFiles            map[string]os.FileInfo // files listed when the active window closed.
+	missed                 []Event                // events deferred when the active window closed.
+
+	deadlines map[string]*deadline // paths that have to be written to regularly.
+
+	logger *log.Logger // logs why files aren't watched.
+
+	globIncludes IgnoreMatcher // files have to match these to be watched.
+	globExcludes IgnoreMatcher // files that match these aren't watched.
+
+	ignoreFunc func(path string, info os.FileInfo) bool // decides whether new files are ignored.
+
+	coalesceByDir bool // send one event per directory that changed.
+
+	removeOrder RemoveOrder // order of the Remove events of nested files.
+
+	checksums  map[string]string   // expected SHA-256 checksums of files.
+	unverified map[string]struct{} // files whose checksums need checking.
+
+	state     WatcherState                // where the watcher is in its lifecycle.
+	stateHook func(old, new WatcherState) // called when the state changes.
+
+	scanConcurrency int // names listed at once each cycle.
+
+	excluded map[string]struct{} // paths removed from recursively watched directories.
+
+	triggerMode TriggerMode             // whether unacknowledged files cause events each cycle.
+	ackTimeout  time.Duration           // resend unacknowledged events after this long.
+	unacked     map[string]unackedEvent // sent events that haven't been acknowledged.
+	sources     map[string]Event        // queued events before rewriting, by path.
+
+	schedules map[string]*schedule // names listed on their own schedule.
+
+	deltaThreshold int // changes to the number of files before warning.
+
+	drained chan struct{} // closed when the queue is emptied by Drain.
+	started chan struct{} // closed once Start unblocks Wait.
+	synced  chan struct{} // closed once the first cycle's events are sent.
+
+	ignorePreexisting    bool // ignore changes made before starting.
+	skipPermissionErrors bool // skip files that can't be listed.
+	stopAfterFirstEvent  bool // close after sending one event.
+	sentFirstEvent       bool // whether an event has been sent since starting.
+
+	tickHook func(cycle uint64) // called at the start of every cycle.
+
+	scanReport func(result ScanResult) // called after the first scan.
+	scanErrors []error                 // errors from the latest scan.
+
+	maxEventDepth int  // deepest files that events are sent for.
+	ignoreRoots   bool // drop events for added names themselves.
+
+	lastEvents *eventCache // last events sent for paths.
+
+	allowEmpty bool // allow starting without anything to watch.
+
+	interval        time.Duration // time between cycles.
+	configured      time.Duration // interval set by NewWithConfig.
+	lastCycle       time.Time     // when the latest cycle started.
+	intervalChanged chan struct{} // signals Start when the interval changes.
+
+	minInterval, maxInterval time.Duration // range the interval adapts within.
+	pinned                   int           // calls to WithInterval keeping the interval.
+
+	sink   chan<- Event // where events are sent instead of Event.
+	stream *eventStream // where events are written instead of sent.
 }
 
 // New creates a new Watcher.
@@ -192,13 +805,88 @@ func New() *Watcher {
 		Event:   make(chan Event),
 		Error:   make(chan error),
 		Closed:  make(chan struct{}),
-		close:   make(chan struct{}),
+		close:   make(chan struct{}, 1), // so Close doesn't block in Start's goroutine.
 		mu:      new(sync.Mutex),
 		wg:      &wg,
 		files:   make(map[string]os.FileInfo),
 		ignored: make(map[string]struct{}),
+		pruned:  make(map[string]struct{}),
+		aliases: make(map[string]string),
 		names:   make(map[string]bool),
+		depths:  make(map[string]int),
+		shallow: make(map[string]struct{}),
+
+		excluded: make(map[string]struct{}),
+		unacked:  make(map[string]unackedEvent),
+		sources:  make(map[string]Event),
+
+		schedules: make(map[string]*schedule),
+		drained:   make(chan struct{}),
+		started:   make(chan struct{}),
+		synced:    make(chan struct{}),
+
+		intervalChanged: make(chan struct{}, 1),
+
+		unstable: make(map[string]*unstableFile),
+		followed: make(map[string]struct{}),
+		clock:    realClock{},
+
+		countTriggers: make(map[string]*countTrigger),
+		suppressed:    make(map[string]struct{}),
+
+		matching: make(map[string]matching),
+
+		deadlines: make(map[string]*deadline),
+
+		checksums:  make(map[string]string),
+		unverified: make(map[string]struct{}),
+	}
+}
+
+// Events returns the channel that events are sent on.
+func (w *Watcher) Events() <-chan Event {
+	return w.Event
+}
+
+// Errors returns the channel that errors are sent on.
+func (w *Watcher) Errors() <-chan error {
+	return w.Error
+}
+
+// Done returns the channel that's closed once the watcher has closed. Reset
+// replaces it, so it has to be called again after a reset.
+func (w *Watcher) Done() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Closed
+}
+
+// projectIgnores are the build output and dependency directories
+// that are ignored by NewForProject.
+var projectIgnores = []string{
+	"node_modules",
+	"bower_components",
+	"vendor",
+	"target",
+	"__pycache__",
+}
+
+// NewForProject creates a new Watcher that recursively watches the project
+// directory root, ignoring hidden files and common build output and
+// dependency directories such as node_modules and vendor.
+func NewForProject(root string) (*Watcher, error) {
+	w := New()
+	w.IgnoreHiddenFiles(true)
+
+	if err := w.IgnoreGlob(projectIgnores...); err != nil {
+		return nil, err
 	}
+	if err := w.AddRecursive(root); err != nil {
+		return nil, err
+	}
+
+	return w, nil
 }
 
 // SetMaxEvents controls the maximum amount of events that are sent on
@@ -213,49 +901,358 @@ func (w *Watcher) SetMaxEvents(delta int) {
 // AddFilterHook
 func (w *Watcher) AddFilterHook(f FilterFileHookFunc) {
 	w.mu.Lock()
-	w.ffh = append(w.ffh, f)
+	w.ffh = append(w.ffh, func(info os.FileInfo, fullPath, root string) error {
+		return f(info, fullPath)
+	})
 	w.mu.Unlock()
 }
 
-// IgnoreHiddenFiles sets the watcher to ignore any file or directory
-// that starts with a dot.
-func (w *Watcher) IgnoreHiddenFiles(ignore bool) {
+// AddEventFilterHook adds a hook that's called for every event before it's
+// sent. Events that any of the hooks return false for aren't sent.
+func (w *Watcher) AddEventFilterHook(f EventFilterHookFunc) {
 	w.mu.Lock()
-	w.ignoreHidden = ignore
+	w.efh = append(w.efh, f)
 	w.mu.Unlock()
 }
 
-// FilterOps filters which event op types should be returned
-// when an event occurs.
-func (w *Watcher) FilterOps(ops ...Op) {
+// AddRootFilterHook adds a filter hook that also receives the root path
+// that a file is being listed under.
+func (w *Watcher) AddRootFilterHook(f FilterFileRootHookFunc) {
 	w.mu.Lock()
-	w.ops = make(map[Op]struct{})
-	for _, op := range ops {
-		w.ops[op] = struct{}{}
-	}
+	w.ffh = append(w.ffh, f)
+	w.rootHooks = true
 	w.mu.Unlock()
 }
 
-// Add adds either a single file or directory to the file list.
-func (w *Watcher) Add(name string) (err error) {
+// AddFilterOpsHook adds a filter hook that accepts or rejects files for
+// listing like the ones added with AddFilterHook, and also limits events for
+// the files it accepts to the ops that it returns for them. Events of other
+// ops are dropped, whatever FilterOps allows. f is called once for each
+// file when it's listed, and the ops it returns are kept for the file's
+// events until it's listed again.
+func (w *Watcher) AddFilterOpsHook(f FilterFileOpsHookFunc) {
+	h := &opsHook{ops: make(map[string][]Op)}
+	w.mu.Lock()
+	w.ffh = append(w.ffh, func(info os.FileInfo, fullPath, root string) error {
+		accept, ops := f(info, fullPath)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !accept || len(ops) == 0 {
+			delete(h.ops, fullPath)
+		} else {
+			h.ops[fullPath] = ops
+		}
+		if !accept {
+			return ErrSkip
+		}
+		return nil
+	})
+	w.opsHooks = append(w.opsHooks, h)
+	w.mu.Unlock()
+}
+
+// An opsHook has the ops that a hook added with AddFilterOpsHook limited
+// the events of each file to when it was last listed. Files can be listed
+// on several goroutines at once, so ops is guarded by mu.
+type opsHook struct {
+	mu  sync.Mutex
+	ops map[string][]Op
+}
+
+// FilterHookCount returns the number of filter hooks added with AddFilterHook,
+// AddRootFilterHook and AddFilterOpsHook.
+func (w *Watcher) FilterHookCount() int {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	name, err = filepath.Abs(name)
-	if err != nil {
-		return err
-	}
+	return len(w.ffh)
+}
 
-	// If name is on the ignored list or if hidden files are
-	// ignored and name is a hidden file or directory, simply return.
-	_, ignored := w.ignored[name]
+// ClearFilterHooks removes the filter hooks added with AddFilterHook,
+// AddRootFilterHook and AddFilterOpsHook, so that files are no longer
+// filtered by them from the next listing on. Event filter hooks are kept.
+func (w *Watcher) ClearFilterHooks() {
+	w.mu.Lock()
+	w.ffh = nil
+	w.rootHooks = false
+	w.opsHooks = nil
+	w.mu.Unlock()
+}
+
+// SetLogger sets a logger that the watcher logs to whenever a filter hook
+// rejects a file while ExplainPath explains it, naming the hook by the order
+// it was added in, starting from 1. Rejections found while listing aren't
+// logged, since the same files are rejected every cycle. If l is nil,
+// nothing is logged, which is the default.
+func (w *Watcher) SetLogger(l *log.Logger) {
+	w.mu.Lock()
+	w.logger = l
+	w.mu.Unlock()
+}
 
-	isHidden, err := isHiddenFile(name)
+// ExplainPath returns the decisions that make the file at path watched or
+// not, such as which filter hooks accept or reject it, for debugging. The
+// last one is either "watched" or "not watched". They're made again from
+// how the file is now, so they might not match whether it's watched until
+// the next cycle. Making them calls the filter hooks and the ignore func, and
+// what hooks made by this package remember, such as the ops that
+// AddFilterOpsHook keeps and what ContentTypeFilterHook sniffed, is put
+// back afterwards, so that explaining a path doesn't change what's sent. Any
+// state of other hooks isn't, so it's up to them not to keep any.
+func (w *Watcher) ExplainPath(path string) []string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return []string{err.Error(), "not watched"}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := w.listerOf(path)
+	if name == "" {
+		return []string{path + " isn't added or below anything added", "not watched"}
+	}
+	decisions := []string{path + " is below " + name}
+	if path == name {
+		decisions = []string{path + " is added"}
+	}
+
+	// Judge the directories between name and path from the top like
+	// listing name does, since nothing below them is watched if they
+	// aren't descended into.
+	var paths []string
+	for p := path; p != name; p = filepath.Dir(p) {
+		paths = append([]string{p}, paths...)
+	}
+	l := &listing{name: name, recursive: w.names[name], pruned: make(map[string]struct{})}
+	if l.recursive || path == name {
+		paths = append([]string{name}, paths...)
+	}
+	for _, p := range paths {
+		info, err := os.Lstat(extendedPath(p))
+		if err != nil {
+			return append(decisions, err.Error(), "not watched")
+		}
+		var notes []string
+		restore := w.saveHookState(p)
+		watched, descend, err := w.judge(info, p, l, func(note string) {
+			notes = append(notes, note)
+		})
+		restore()
+		if err != nil {
+			return append(decisions, err.Error(), "not watched")
+		}
+		if p == path {
+			decisions = append(decisions, notes...)
+			if !watched {
+				return append(decisions, "not watched")
+			}
+			break
+		}
+		if !descend {
+			// Only say why a directory above path stops the listing.
+			decisions = append(decisions, notes...)
+			return append(decisions, p+" isn't descended into", "not watched")
+		}
+	}
+	return append(decisions, "watched")
+}
+
+// saveHookState saves what the hooks made by this package remember about
+// path, and returns a function that puts it back.
+func (w *Watcher) saveHookState(path string) func() {
+	var restores []func()
+	for _, h := range w.opsHooks {
+		restores = append(restores, h.save(path))
+	}
+	sniffCaches.Lock()
+	for c := range sniffCaches.caches {
+		restores = append(restores, c.save(path))
+	}
+	sniffCaches.Unlock()
+
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+// listerOf returns the name whose listing path is found in, or "" if there
+// isn't one.
+func (w *Watcher) listerOf(path string) string {
+	var lister string
+	for name, recursive := range w.names {
+		if len(name) <= len(lister) || w.covered(name) {
+			continue
+		}
+		if path == name || recursive && isUnder(path, name) || filepath.Dir(path) == name {
+			lister = name
+		}
+	}
+	return lister
+}
+
+// listing is what's known about a name while listing it.
+type listing struct {
+	name      string
+	recursive bool
+	dev       uint64
+	devKnown  bool
+
+	// pruned is where new directories that aren't auto-watched are added,
+	// when it isn't nil. Directories can be listed on several goroutines
+	// at once, so it's guarded by mu.
+	mu     sync.Mutex
+	pruned map[string]struct{}
+}
+
+// judge decides whether the file at path found while listing l is watched,
+// and whether it's descended into if it's a directory, calling note with
+// each decision made along the way if it isn't nil. Listing and ExplainPath
+// both use it, so that they never disagree.
+func (w *Watcher) judge(info os.FileInfo, path string, l *listing, note func(string)) (watched, descend bool, err error) {
+	// Rejections are only logged while explaining, since listing judges
+	// the same files every cycle.
+	explaining := note != nil
+	if !explaining {
+		note = ignore
+	}
+
+	reason, err := w.ignoreReason(path, info, path == l.name)
+	if err != nil {
+		return false, false, err
+	}
+	if reason != "" {
+		note(path + reason)
+		return false, false, nil
+	}
+
+	// Files that are filtered out aren't watched, but directories that
+	// are still have their contents listed.
+	for i, f := range w.ffh {
+		if err := f(info, path, l.name); err != nil {
+			if err != ErrSkip {
+				return false, false, err
+			}
+			if explaining && w.logger != nil {
+				w.logger.Printf("%s rejected by hook #%d", path, i+1)
+			}
+			note(fmt.Sprintf("%s rejected by hook #%d", path, i+1))
+			return false, true, nil
+		}
+		note(fmt.Sprintf("%s accepted by hook #%d", path, i+1))
+	}
+	if !w.matches(info, path, l.name) {
+		note(path + " doesn't match the pattern of " + l.name)
+		return false, true, nil
+	}
+	if !w.included(info, path, l.name) {
+		note(path + " doesn't match any include globs")
+		return false, true, nil
+	}
+	if !info.IsDir() || !l.recursive {
+		return true, false, nil
+	}
+
+	if path == l.name && w.sameFilesystemOnly {
+		l.dev, l.devKnown = device(info)
+	}
+	if path == l.name {
+		return true, true, nil
+	}
+	if gated(path, w.dirGate) {
+		note(path + " contains " + w.dirGate)
+		return true, false, nil
+	}
+
+	// Don't descend into directories that are on other filesystems when
+	// they shouldn't be, that are as deep as name's depth limit allows or
+	// that aren't auto-watched.
+	if d, known := device(info); l.devKnown && known && d != l.dev {
+		note(path + " is on another filesystem than " + l.name)
+		return true, false, nil
+	}
+	if depth, limited := w.depths[l.name]; limited && depthBelow(path, l.name) >= depth {
+		note(fmt.Sprintf("%s is at the depth limit of %d below %s", path, depth, l.name))
+		return true, false, nil
+	}
+	if _, pruned := w.pruned[path]; pruned {
+		note(path + " is a new directory that isn't auto-watched")
+		return true, false, nil
+	}
+	if _, known := w.files[path]; l.pruned != nil && !known && !w.autoWatched(path) {
+		l.mu.Lock()
+		l.pruned[path] = struct{}{}
+		l.mu.Unlock()
+		note(path + " is a new directory that isn't auto-watched")
+		return true, false, nil
+	}
+	return true, true, nil
+}
+
+// ignore is a note func for judging files without keeping the decisions.
+func ignore(string) {}
+
+// IgnoreHiddenFiles sets the watcher to ignore any file or directory
+// that starts with a dot.
+func (w *Watcher) IgnoreHiddenFiles(ignore bool) {
+	w.mu.Lock()
+	w.ignoreHidden = ignore
+	w.mu.Unlock()
+}
+
+// FilterOps filters which event op types should be returned
+// when an event occurs. Calling it with no ops or with AllOps
+// stops filtering, so events of every op are returned.
+func (w *Watcher) FilterOps(ops ...Op) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ops = nil
+	for _, op := range ops {
+		if op == AllOps {
+			w.ops = nil
+			return
+		}
+		if w.ops == nil {
+			w.ops = make(map[Op]struct{})
+		}
+		w.ops[op] = struct{}{}
+	}
+}
+
+// SuppressAllOps filters out events of every op, so no events are
+// returned until FilterOps is called again.
+func (w *Watcher) SuppressAllOps() {
+	w.mu.Lock()
+	w.ops = make(map[Op]struct{})
+	w.mu.Unlock()
+}
+
+// Add adds either a single file or directory to the file list.
+//
+// A directory's entries are watched, but not what's in its subdirectories.
+// A Create event is still sent when a subdirectory is created in it, so
+// that the subdirectory can be added too if needed, but its contents stay
+// unwatched until it is.
+func (w *Watcher) Add(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = filepath.Abs(name)
 	if err != nil {
 		return err
 	}
+	w.include(name)
 
-	if ignored || (w.ignoreHidden && isHidden) {
+	// If name is on the ignored list or if hidden files are
+	// ignored and name is a hidden file or directory, simply return.
+	ignored, err := w.isIgnored(name, nil)
+	if err != nil {
+		return err
+	}
+	if ignored {
 		return nil
 	}
 
@@ -270,15 +1267,98 @@ func (w *Watcher) Add(name string) (err error) {
 
 	// Add the name to the names list.
 	w.names[name] = false
+	delete(w.schedules, name)
+
+	return nil
+}
+
+// schedule is when a name added with AddWithInterval is next listed.
+type schedule struct {
+	interval time.Duration
+	due      time.Time
+	files    map[string]os.FileInfo // the files found when it was last listed.
+}
+
+// AddWithInterval adds a single file or directory like Add does, but only
+// checks it for changes every d instead of every polling cycle. Checks still
+// happen during polling cycles, so d is effectively rounded up to a multiple
+// of the polling interval. A file or directory below a recursively watched
+// directory is still checked along with that directory every cycle.
+func (w *Watcher) AddWithInterval(name string, d time.Duration) error {
+	if d < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if err := w.Add(name); err != nil {
+		return err
+	}
 
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, found := w.names[name]; found {
+		// It's listed during the next cycle, which starts its schedule.
+		w.schedules[name] = &schedule{interval: d}
+	}
 	return nil
 }
 
+// scheduled returns the files found the last time name was listed if it
+// has its own schedule and it isn't due to be listed again yet.
+func (w *Watcher) scheduled(name string, now time.Time) (map[string]os.FileInfo, bool) {
+	s, found := w.schedules[name]
+	if !found || s.files == nil || !now.Before(s.due) {
+		return nil, false
+	}
+	return s.files, true
+}
+
+// NextScan returns when path is next due to be checked for changes, which is
+// during the next polling cycle unless it was added with AddWithInterval and
+// isn't due yet. Cycles are assumed to happen every polling interval from the
+// latest one, so the time is an estimate. It returns false if path isn't
+// watched, or if the watcher isn't running or is paused.
+func (w *Watcher) NextScan(path string) (time.Time, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.state != Running {
+		return time.Time{}, false
+	}
+	if _, found := w.files[path]; !found {
+		return time.Time{}, false
+	}
+
+	// Before the first cycle, it starts straight away.
+	if w.lastCycle.IsZero() {
+		return w.clock.Now(), true
+	}
+	next := w.lastCycle.Add(w.interval)
+
+	// Names with their own schedule are checked during the first cycle
+	// after they're due.
+	root := w.rootOf(path)
+	if s, found := w.schedules[root]; found && s.files != nil && !w.covered(root) && next.Before(s.due) {
+		cycles := (s.due.Sub(next) + w.interval - 1) / w.interval
+		next = next.Add(cycles * w.interval)
+	}
+	return next, true
+}
+
 func (w *Watcher) list(name string) (map[string]os.FileInfo, error) {
 	fileList := make(map[string]os.FileInfo)
 
 	// Make sure name exists.
-	stat, err := os.Stat(name)
+	stat, err := os.Stat(extendedPath(name))
 	if err != nil {
 		return nil, err
 	}
@@ -291,143 +1371,173 @@ func (w *Watcher) list(name string) (map[string]os.FileInfo, error) {
 	}
 
 	// It's a directory.
-	fInfoList, err := ioutil.ReadDir(name)
+	fInfoList, err := ioutil.ReadDir(extendedPath(name))
 	if err != nil {
 		return nil, err
 	}
-	// Add all of the files in the directory to the file list as long
-	// as they aren't on the ignored list or are hidden files if ignoreHidden
-	// is set to true.
-outer:
+	// Add all of the files in the directory that are watched to the
+	// file list.
+	l := &listing{name: name}
 	for _, fInfo := range fInfoList {
 		path := filepath.Join(name, fInfo.Name())
-		_, ignored := w.ignored[path]
 
-		isHidden, err := isHiddenFile(path)
+		watched, _, err := w.judge(fInfo, path, l, nil)
 		if err != nil {
 			return nil, err
 		}
-
-		if ignored || (w.ignoreHidden && isHidden) {
-			continue
-		}
-
-		for _, f := range w.ffh {
-			err := f(fInfo, path)
-			if err == ErrSkip {
-				continue outer
-			}
-			if err != nil {
-				return nil, err
-			}
+		if watched {
+			fileList[path] = fInfo
 		}
-
-		fileList[path] = fInfo
 	}
 	return fileList, nil
 }
 
-// AddRecursive adds either a single file or directory recursively to the file list.
-func (w *Watcher) AddRecursive(name string) (err error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	name, err = filepath.Abs(name)
+// AddShallow adds a directory like Add does, but only its entries being
+// created, removed, renamed or moved cause events. Writes and mode changes
+// of the directory and its entries are ignored.
+func (w *Watcher) AddShallow(dir string) error {
+	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return err
 	}
 
-	fileList, err := w.listRecursive(name)
-	if err != nil {
+	if err := w.Add(dir); err != nil {
 		return err
 	}
-	for k, v := range fileList {
-		w.files[k] = v
-	}
 
-	// Add the name to the names list.
-	w.names[name] = true
+	w.mu.Lock()
+	w.shallow[dir] = struct{}{}
+	w.mu.Unlock()
 
 	return nil
 }
 
-func (w *Watcher) listRecursive(name string) (map[string]os.FileInfo, error) {
-	fileList := make(map[string]os.FileInfo)
+// AddRecursive adds either a single file or directory recursively to the file list.
+//
+// If permission errors are skipped, everything else is still added when
+// some files can't be listed, and a *MultiError of the errors is returned.
+func (w *Watcher) AddRecursive(name string) (err error) {
+	return w.addRecursive(name, 0)
+}
 
-	return fileList, filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// WatchSpec describes a file or directory to watch using AddPaths.
+type WatchSpec struct {
+	Path string
 
-		for _, f := range w.ffh {
-			err := f(info, path)
-			if err == ErrSkip {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-		}
+	// Recursive sets whether a directory is watched recursively.
+	Recursive bool
 
-		// If path is ignored and it's a directory, skip the directory. If it's
-		// ignored and it's a single file, skip the file.
-		_, ignored := w.ignored[path]
+	// Depth limits how many levels of directories below Path are watched
+	// recursively, where 1 only watches Path's contents like Add does. If
+	// Depth is less than 1, there's no limit.
+	Depth int
+}
 
-		isHidden, err := isHiddenFile(path)
+// AddPaths adds each of the files or directories described by specs, either
+// recursively or not. It stops and returns the first error encountered.
+func (w *Watcher) AddPaths(specs ...WatchSpec) error {
+	for _, spec := range specs {
+		var err error
+		if spec.Recursive {
+			err = w.addRecursive(spec.Path, spec.Depth)
+		} else {
+			err = w.Add(spec.Path)
+		}
 		if err != nil {
 			return err
 		}
-
-		if ignored || (w.ignoreHidden && isHidden) {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		// Add the path and it's info to the file list.
-		fileList[path] = info
-		return nil
-	})
+	}
+	return nil
 }
 
-// Remove removes either a single file or directory from the file's list.
-func (w *Watcher) Remove(name string) (err error) {
+// ReplaceRoots replaces everything being watched with the files or
+// directories described by specs in one go, so that there's no time when
+// neither the old nor the new ones are watched. If the watcher is running,
+// instead of events for all of the old files being removed and all of the
+// new ones being created, only a Create event for each file that wasn't
+// watched before and a Remove event for each file that's no longer watched
+// are sent, during the next cycle. If any of specs can't be added, the error
+// is returned and what's watched is left as it was.
+func (w *Watcher) ReplaceRoots(specs ...WatchSpec) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	name, err = filepath.Abs(name)
-	if err != nil {
-		return err
-	}
+	// Listing uses the depths, exclusions and pruned directories of the
+	// names being listed, so replace them first and put them back on
+	// errors.
+	oldDepths, oldExcluded, oldPruned := w.depths, w.excluded, w.pruned
+	w.depths = make(map[string]int)
+	w.excluded = make(map[string]struct{})
+	w.pruned = make(map[string]struct{})
 
-	// Remove the name from w's names list.
-	delete(w.names, name)
+	names := make(map[string]bool)
+	files := make(map[string]os.FileInfo)
+	var skipped []error
+	for _, spec := range specs {
+		list, err := w.listSpec(spec, names)
+		if m, ok := err.(*MultiError); ok {
+			skipped = append(skipped, m.errs...)
+		} else if err != nil {
+			w.depths, w.excluded, w.pruned = oldDepths, oldExcluded, oldPruned
+			return err
+		}
+		for k, v := range list {
+			files[k] = v
+		}
+	}
 
-	// If name is a single file, remove it and return.
-	info, found := w.files[name]
-	if !found {
-		return nil // Doesn't exist, just return.
+	var events []Event
+	for _, path := range sortedPaths(files) {
+		if _, found := w.files[path]; !found {
+			events = append(events, Event{Op: Create, Path: path, FileInfo: files[path]})
+		}
 	}
-	if !info.IsDir() {
-		delete(w.files, name)
-		return nil
+	for _, path := range sortedPaths(w.files) {
+		if _, found := files[path]; !found {
+			events = append(events, Event{Op: Remove, Path: path, OldPath: path, FileInfo: w.files[path]})
+		}
 	}
 
-	// Delete the actual directory from w.files
-	delete(w.files, name)
+	w.files = files
+	w.names = names
+	w.shallow = make(map[string]struct{})
+	w.matching = make(map[string]matching)
+	w.schedules = make(map[string]*schedule)
+	if w.running {
+		w.deferred = append(w.deferred, w.filterEvents(events)...)
+	}
 
-	// If it's a directory, delete all of it's contents from w.files.
-	for path := range w.files {
-		if filepath.Dir(path) == name {
-			delete(w.files, path)
-		}
+	if len(skipped) > 0 {
+		return &MultiError{errs: skipped}
 	}
 	return nil
 }
 
-// RemoveRecursive removes either a single file or a directory recursively from
-// the file's list.
-func (w *Watcher) RemoveRecursive(name string) (err error) {
+// listSpec lists the file or directory described by spec for ReplaceRoots,
+// adding it to names if it isn't ignored.
+func (w *Watcher) listSpec(spec WatchSpec, names map[string]bool) (map[string]os.FileInfo, error) {
+	name, err := filepath.Abs(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+	ignored, err := w.isIgnored(name, nil)
+	if err != nil || ignored {
+		return nil, err
+	}
+
+	names[name] = spec.Recursive
+	if !spec.Recursive {
+		return w.list(name)
+	}
+	if spec.Depth > 0 {
+		w.depths[name] = spec.Depth
+	}
+	return w.listRecursive(name, nil, nil)
+}
+
+// addRecursive adds name recursively, up to depth levels of directories
+// below it if depth is at least 1.
+func (w *Watcher) addRecursive(name string, depth int) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -435,32 +1545,539 @@ func (w *Watcher) RemoveRecursive(name string) (err error) {
 	if err != nil {
 		return err
 	}
-
-	// Remove the name from w's names list.
-	delete(w.names, name)
-
-	// If name is a single file, remove it and return.
-	info, found := w.files[name]
-	if !found {
-		return nil // Doesn't exist, just return.
+	w.include(name)
+	for path := range w.pruned {
+		if isUnder(path, name) {
+			delete(w.pruned, path)
+		}
 	}
-	if !info.IsDir() {
-		delete(w.files, name)
-		return nil
+
+	if depth > 0 {
+		w.depths[name] = depth
+	} else {
+		delete(w.depths, name)
 	}
 
-	// If it's a directory, delete all of it's contents recursively
-	// from w.files.
-	for path := range w.files {
-		if strings.HasPrefix(path, name) {
-			delete(w.files, path)
+	// If name is already being watched as part of another recursively
+	// watched directory, its contents don't need to be listed again.
+	var skipped error
+	if _, found := w.files[name]; !found || !w.covered(name) {
+		fileList, err := w.listRecursive(name, nil, nil)
+		if _, ok := err.(*MultiError); ok {
+			skipped = err
+		} else if err != nil {
+			return err
+		}
+		for k, v := range fileList {
+			w.files[k] = v
 		}
 	}
-	return nil
+
+	// Add the name to the names list.
+	w.names[name] = true
+	delete(w.schedules, name)
+
+	return skipped
 }
 
-// Ignore adds paths that should be ignored.
-//
+// covered reports whether name is below a directory that's being
+// watched recursively. Root filter hooks can accept different files
+// depending on the root, so nothing is covered when there are any.
+func (w *Watcher) covered(name string) bool {
+	if w.rootHooks {
+		return false
+	}
+	for root, recursive := range w.names {
+		if _, limited := w.depths[root]; recursive && !limited && isUnder(name, root) {
+			if _, found := w.matching[root]; !found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matching is the pattern that a name added with AddMatching was added with.
+type matching struct {
+	pattern   string
+	recursive bool
+}
+
+// AddMatching adds the directory dir like Add does, or like AddRecursive does
+// if recursive is set, but only watches the files in it whose names match
+// pattern, as understood by filepath.Match. Files created later are only
+// watched if they match too. When dir is watched recursively, the
+// directories below it are watched so that the matching files in them are
+// found, but like dir itself, no events are sent for them.
+func (w *Watcher) AddMatching(dir, pattern string, recursive bool) error {
+	// Make sure the pattern is well formed.
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.matching[dir] = matching{pattern: pattern, recursive: recursive}
+	w.mu.Unlock()
+
+	if recursive {
+		err = w.AddRecursive(dir)
+	} else {
+		err = w.Add(dir)
+	}
+	if _, ok := err.(*MultiError); err != nil && !ok {
+		w.mu.Lock()
+		delete(w.matching, dir)
+		w.mu.Unlock()
+	}
+	return err
+}
+
+// matches reports whether path, which is being listed under name, matches
+// the pattern that name was added with by AddMatching, if any. Directories
+// below names that are watched recursively always match so that they're
+// descended into.
+func (w *Watcher) matches(info os.FileInfo, path, name string) bool {
+	m, found := w.matching[name]
+	if !found || path == name || m.recursive && info.IsDir() {
+		return true
+	}
+	matched, _ := filepath.Match(m.pattern, info.Name())
+	return matched
+}
+
+// unmatched reports whether event is for a directory added with AddMatching
+// or for one below it, which no events are sent for.
+func (w *Watcher) unmatched(event Event) bool {
+	for root, m := range w.matching {
+		if event.Path == root {
+			return true
+		}
+		if m.recursive && event.FileInfo != nil && event.IsDir() && isUnder(event.Path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// listRecursive lists name and everything below it. When pruned isn't nil,
+// directories created since the last cycle are only descended into if
+// auto-watching is allowed for them, and the ones that aren't are added
+// to pruned. The directories below name are listed on separate goroutines
+// whenever one of sem's slots is free, or all on this one if sem is nil.
+//
+// If permission errors are skipped, files that can't be listed because of
+// them are left out and the errors are returned in a *MultiError.
+func (w *Watcher) listRecursive(name string, pruned map[string]struct{}, sem chan struct{}) (map[string]os.FileInfo, error) {
+	wk := &walker{
+		w:     w,
+		l:     &listing{name: name, recursive: true, pruned: pruned},
+		sem:   sem,
+		files: make(map[string]os.FileInfo),
+	}
+
+	// Walk name like filepath.Walk does.
+	root := extendedPath(name)
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = wk.visit(root, nil, err)
+	} else {
+		err = wk.walk(root, info)
+	}
+	wk.wg.Wait()
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	if err == nil {
+		err = wk.err
+	}
+	if err == nil && len(wk.skipped) > 0 {
+		err = &MultiError{errs: wk.skipped}
+	}
+	return wk.files, err
+}
+
+// walker walks a recursively watched name for listRecursive.
+type walker struct {
+	w   *Watcher
+	l   *listing
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex // guards the fields below.
+	files   map[string]os.FileInfo
+	skipped []error
+	err     error // the first error from the directories walked on other goroutines.
+}
+
+// walk walks the file at path and everything below it, visiting each of
+// them like filepath.Walk does.
+func (wk *walker) walk(path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return wk.visit(path, info, nil)
+	}
+
+	names, err := readDirNames(path)
+	err1 := wk.visit(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, name := range names {
+		if wk.failed() {
+			return nil
+		}
+		filename := filepath.Join(path, name)
+		fileInfo, err := os.Lstat(filename)
+		if err != nil {
+			if err := wk.visit(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if fileInfo.IsDir() && spread(wk.sem, &wk.wg, func() {
+			if err := wk.walk(filename, fileInfo); err != nil && err != filepath.SkipDir {
+				wk.fail(err)
+			}
+		}) {
+			continue
+		}
+		if err := wk.walk(filename, fileInfo); err != nil {
+			if !fileInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// visit decides whether the file at path is listed and whether it's
+// descended into if it's a directory, like filepath.Walk's walk functions.
+func (wk *walker) visit(path string, info os.FileInfo, err error) error {
+	w := wk.w
+	if err != nil {
+		if !w.skipPermissionErrors || !os.IsPermission(err) {
+			return err
+		}
+		wk.mu.Lock()
+		wk.skipped = append(wk.skipped, err)
+		wk.mu.Unlock()
+		// A directory that can't be read is still listed itself.
+		if info == nil {
+			return nil
+		}
+	}
+	path = cleanPath(path)
+
+	watched, descend, err := w.judge(info, path, wk.l, nil)
+	if err != nil {
+		return err
+	}
+	if watched {
+		wk.mu.Lock()
+		wk.files[path] = info
+		wk.mu.Unlock()
+	}
+	if info.IsDir() && !descend {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// fail records err if it's the first error from the directories walked on
+// other goroutines.
+func (wk *walker) fail(err error) {
+	wk.mu.Lock()
+	if wk.err == nil {
+		wk.err = err
+	}
+	wk.mu.Unlock()
+}
+
+// failed reports whether walking any of the directories failed on another
+// goroutine, so that the others can stop early.
+func (wk *walker) failed() bool {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+	return wk.err != nil
+}
+
+// readDirNames returns the sorted names of the entries of the directory dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SetSameFilesystemOnly sets whether recursively watched directories are
+// only watched as far as the filesystem that they're on, like find's -xdev
+// option, so that mount points such as /proc or network mounts below them
+// aren't descended into. Mount points themselves are still watched. Devices
+// are only known on Unix systems, so elsewhere everything is descended into.
+func (w *Watcher) SetSameFilesystemOnly(same bool) {
+	w.mu.Lock()
+	w.sameFilesystemOnly = same
+	w.mu.Unlock()
+}
+
+// SetDirGate makes the directories below recursively watched directories
+// that contain a file named markerName, such as ".processed", stop being
+// watched until it's removed. The directory itself is still watched, but
+// nothing in it is, including the marker, and no Remove events are sent for
+// the files in it when the marker appears. Once the marker is removed, the
+// directory's contents are watched again and Create events are sent for
+// them. Each directory is checked for the marker every polling cycle. If
+// markerName is empty, directories aren't gated, which is the default. The
+// watched directories themselves are never gated, even if they contain the
+// marker.
+func (w *Watcher) SetDirGate(markerName string) {
+	w.mu.Lock()
+	w.dirGate = markerName
+	w.mu.Unlock()
+}
+
+// gated reports whether the directory dir contains a file named marker.
+func gated(dir, marker string) bool {
+	if marker == "" {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(dir, marker))
+	return err == nil
+}
+
+// ungated drops the Remove events of files that are still there, but that
+// aren't watched anymore because a directory that they're in in files was
+// gated by SetDirGate.
+func (w *Watcher) ungated(events []Event, files map[string]os.FileInfo) []Event {
+	if w.dirGate == "" {
+		return events
+	}
+	kept := events[:0]
+	for _, event := range events {
+		if event.Op != Remove || !w.gatedBy(event.Path, files) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// gatedBy reports whether any of the directories that path is in that are
+// in files are gated.
+func (w *Watcher) gatedBy(path string, files map[string]os.FileInfo) bool {
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		info, found := files[dir]
+		if !found {
+			return false
+		}
+		if _, root := w.names[dir]; !root && info.IsDir() && gated(dir, w.dirGate) {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiError is a list of errors that occurred while doing something that
+// carried on regardless of them.
+type MultiError struct {
+	errs []error
+}
+
+// Errors returns the errors that occurred.
+func (e *MultiError) Errors() []error {
+	return append([]error(nil), e.errs...)
+}
+
+func (e *MultiError) Error() string {
+	if len(e.errs) == 1 {
+		return e.errs[0].Error()
+	}
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(e.errs), strings.Join(msgs, "; "))
+}
+
+// SetSkipPermissionErrors sets whether files and directories that can't be
+// listed because of permission errors are skipped instead of making
+// AddRecursive fail. When they're skipped, AddRecursive still adds everything
+// else and returns a *MultiError of the permission errors, and they're
+// ignored while polling.
+func (w *Watcher) SetSkipPermissionErrors(skip bool) {
+	w.mu.Lock()
+	w.skipPermissionErrors = skip
+	w.mu.Unlock()
+}
+
+// SetAutoWatchNewDirs restricts the directories that are automatically
+// watched when they're created below a recursively watched directory to
+// the ones created below parents. New directories created elsewhere
+// still cause events, but their contents aren't watched. If no parents
+// are specified, new directories are never automatically watched.
+func (w *Watcher) SetAutoWatchNewDirs(parents ...string) error {
+	abs := make([]string, 0, len(parents))
+	for _, parent := range parents {
+		parent, err := filepath.Abs(parent)
+		if err != nil {
+			return err
+		}
+		abs = append(abs, parent)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.autoWatchDirs = abs
+	w.restrictAutoWatch = true
+
+	// Start watching the contents of any directories that are now allowed.
+	for path := range w.pruned {
+		if w.autoWatched(path) {
+			delete(w.pruned, path)
+		}
+	}
+
+	return nil
+}
+
+// autoWatched reports whether the contents of the newly created directory
+// path should be watched.
+func (w *Watcher) autoWatched(path string) bool {
+	if !w.restrictAutoWatch {
+		return true
+	}
+	for _, parent := range w.autoWatchDirs {
+		if isUnder(path, parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// depthBelow returns how many levels of directories path is below dir.
+func depthBelow(path, dir string) int {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// isUnder reports whether path is below the directory dir.
+func isUnder(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Remove removes either a single file or directory from the file's list.
+func (w *Watcher) Remove(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	// Remove the name from w's names list.
+	delete(w.names, name)
+	delete(w.depths, name)
+	delete(w.shallow, name)
+	delete(w.schedules, name)
+	delete(w.matching, name)
+
+	// If name is a single file, remove it and return.
+	info, found := w.files[name]
+	if !found {
+		return nil // Doesn't exist, just return.
+	}
+	if !info.IsDir() {
+		delete(w.files, name)
+		return nil
+	}
+
+	// Delete the actual directory from w.files
+	delete(w.files, name)
+
+	// If it's a directory, delete all of it's contents from w.files.
+	for path := range w.files {
+		if filepath.Dir(path) == name {
+			delete(w.files, path)
+		}
+	}
+	return nil
+}
+
+// RemoveRecursive removes either a single file or a directory recursively from
+// the file's list. If name is below a directory that's watched recursively,
+// it stays excluded from that directory, along with anything created below
+// it later, until it's added again.
+func (w *Watcher) RemoveRecursive(name string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	// Remove the name from w's names list.
+	delete(w.names, name)
+	delete(w.depths, name)
+	delete(w.shallow, name)
+	delete(w.schedules, name)
+	delete(w.matching, name)
+
+	for root, recursive := range w.names {
+		if recursive && isUnder(name, root) {
+			w.excluded[name] = struct{}{}
+			break
+		}
+	}
+
+	// If name is a single file, remove it and return.
+	info, found := w.files[name]
+	if !found {
+		return nil // Doesn't exist, just return.
+	}
+	if !info.IsDir() {
+		delete(w.files, name)
+		return nil
+	}
+
+	// If it's a directory, delete all of it's contents recursively
+	// from w.files.
+	for path := range w.files {
+		if strings.HasPrefix(path, name) {
+			delete(w.files, path)
+		}
+	}
+	return nil
+}
+
+// include stops excluding name and anything below it, and stops pruning
+// name, since it's being added explicitly.
+func (w *Watcher) include(name string) {
+	delete(w.pruned, name)
+	for path := range w.excluded {
+		if path == name || isUnder(path, name) {
+			delete(w.excluded, path)
+		}
+	}
+}
+
+// Ignore adds paths that should be ignored.
+//
 // For files that are already added, Ignore removes them.
 func (w *Watcher) Ignore(paths ...string) (err error) {
 	for _, path := range paths {
@@ -468,242 +2085,2717 @@ func (w *Watcher) Ignore(paths ...string) (err error) {
 		if err != nil {
 			return err
 		}
-		// Remove any of the paths that were already added.
-		if err := w.RemoveRecursive(path); err != nil {
-			return err
+		// Remove any of the paths that were already added.
+		if err := w.RemoveRecursive(path); err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.ignored[path] = struct{}{}
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+// IgnoreGlob adds shell file name patterns, as understood by filepath.Match,
+// for files or directories that should be ignored. A pattern is matched
+// against both the name and the full path of a file.
+func (w *Watcher) IgnoreGlob(patterns ...string) error {
+	m, err := GlobIgnoreMatcher(patterns...)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.matchers = append(w.matchers, m)
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SetGlobRules sets which files are watched using shell file name patterns,
+// as understood by filepath.Match, which are matched against both the name
+// and the full path of a file. Files that match any of the exclude patterns
+// aren't watched, and neither is anything below directories that do. Other
+// files are only watched if they match any of the include patterns, unless
+// there are none. Exclude patterns win over include patterns. Include
+// patterns don't apply to directories, so that the files in them can still
+// be found, or to the files and directories added to the watcher
+// themselves. The rules replace any set before, apply to files created later
+// as well, and are removed by calling SetGlobRules with no patterns.
+func (w *Watcher) SetGlobRules(include, exclude []string) error {
+	var includes, excludes IgnoreMatcher
+	var err error
+	if len(include) > 0 {
+		if includes, err = GlobIgnoreMatcher(include...); err != nil {
+			return err
+		}
+	}
+	if len(exclude) > 0 {
+		if excludes, err = GlobIgnoreMatcher(exclude...); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	w.globIncludes, w.globExcludes = includes, excludes
+	w.mu.Unlock()
+
+	return nil
+}
+
+// included reports whether path, which is being listed under name, matches
+// the include patterns set with SetGlobRules, if there are any.
+func (w *Watcher) included(info os.FileInfo, path, name string) bool {
+	if w.globIncludes == nil || path == name || info.IsDir() {
+		return true
+	}
+	return w.globIncludes.Match(path, false)
+}
+
+// AddIgnoreMatcher adds an IgnoreMatcher that decides which files or
+// directories should be ignored, in addition to any already added.
+func (w *Watcher) AddIgnoreMatcher(m IgnoreMatcher) {
+	w.mu.Lock()
+	w.matchers = append(w.matchers, m)
+	w.mu.Unlock()
+}
+
+// IgnoredPaths returns the paths that were ignored using Ignore.
+func (w *Watcher) IgnoredPaths() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	paths := make([]string, 0, len(w.ignored))
+	for path := range w.ignored {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// IgnoredPatterns returns the patterns that files are ignored by: those
+// passed to IgnoreGlob and those of the matchers added with
+// AddIgnoreMatcher, in the order they were added, followed by the exclude
+// patterns set with SetGlobRules. Regular expressions are returned as
+// written, and .gitignore rules as the lines they came from. Matchers that
+// weren't made by this package have no known patterns, so none are
+// returned for them.
+func (w *Watcher) IgnoredPatterns() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	matchers := append([]IgnoreMatcher(nil), w.matchers...)
+	var patterns []string
+	for _, m := range append(matchers, w.globExcludes) {
+		if p, ok := m.(patterned); ok {
+			patterns = append(patterns, p.patterns()...)
+		}
+	}
+	return patterns
+}
+
+// isIgnored reports whether path, which is being added to the watcher, is
+// on the ignored list, was excluded by RemoveRecursive, is matched by an
+// ignore matcher or is a hidden file while hidden files are ignored. If info
+// is nil, path is stat'ed when needed.
+func (w *Watcher) isIgnored(path string, info os.FileInfo) (bool, error) {
+	reason, err := w.ignoreReason(path, info, true)
+	return reason != "", err
+}
+
+// ignoreReason returns why path is ignored, following path, or "" if it
+// isn't. The ignore func isn't asked about roots, the names that are added
+// to the watcher.
+func (w *Watcher) ignoreReason(path string, info os.FileInfo, root bool) (string, error) {
+	if _, ignored := w.ignored[path]; ignored {
+		return " is ignored", nil
+	}
+	if _, excluded := w.excluded[path]; excluded {
+		return " was removed with RemoveRecursive", nil
+	}
+
+	if len(w.matchers) > 0 || w.globExcludes != nil {
+		if info == nil {
+			info, _ = os.Stat(extendedPath(path))
+		}
+		isDir := info != nil && info.IsDir()
+		for i, m := range w.matchers {
+			if m.Match(path, isDir) {
+				return fmt.Sprintf(" is ignored by ignore matcher #%d", i+1), nil
+			}
+		}
+		if w.globExcludes != nil && w.globExcludes.Match(path, isDir) {
+			return " matches an exclude glob", nil
+		}
+	}
+
+	if w.ignoreFunc != nil && info != nil && !root {
+		if _, known := w.files[path]; !known && w.ignoreFunc(path, info) {
+			return " is ignored by the ignore func", nil
+		}
+	}
+
+	if !w.ignoreHidden {
+		return "", nil
+	}
+	hidden, err := isHiddenFile(path)
+	if hidden {
+		return " is hidden", err
+	}
+	return "", err
+}
+
+// SetIgnoreFunc sets a function that decides whether files and directories
+// found while listing are ignored, for when that depends on more than their
+// names, such as on what's in them. It's called for each file that isn't
+// watched yet when it's found, both when it's added and while polling, and
+// if it returns true, the file isn't watched, and neither is anything below
+// it if it's a directory. Once a file is watched, it isn't called for it
+// again. Files that it ignores are checked again every time they're found.
+// It isn't called for the files and directories added to the watcher
+// themselves, and it might be called from several goroutines at once if
+// SetScanConcurrency is used. If f is nil, no files are ignored by it, which
+// is the default.
+func (w *Watcher) SetIgnoreFunc(f func(path string, info os.FileInfo) bool) {
+	w.mu.Lock()
+	w.ignoreFunc = f
+	w.mu.Unlock()
+}
+
+// WatchedFiles returns a map of files added to a Watcher.
+func (w *Watcher) WatchedFiles() map[string]os.FileInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := make(map[string]os.FileInfo)
+	for k, v := range w.files {
+		files[k] = v
+	}
+
+	return files
+}
+
+// WatchedFilesFunc returns a map of the files added to a Watcher that
+// predicate returns true for, such as only the directories.
+func (w *Watcher) WatchedFilesFunc(predicate func(path string, info os.FileInfo) bool) map[string]os.FileInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := make(map[string]os.FileInfo)
+	for k, v := range w.files {
+		if predicate(k, v) {
+			files[k] = v
+		}
+	}
+
+	return files
+}
+
+// fileInfo is an implementation of os.FileInfo that can be used
+// as a mocked os.FileInfo when triggering an event when the specified
+// os.FileInfo is nil.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     interface{}
+	dir     bool
+}
+
+func (fs *fileInfo) IsDir() bool {
+	return fs.dir
+}
+func (fs *fileInfo) ModTime() time.Time {
+	return fs.modTime
+}
+func (fs *fileInfo) Mode() os.FileMode {
+	return fs.mode
+}
+func (fs *fileInfo) Name() string {
+	return fs.name
+}
+func (fs *fileInfo) Size() int64 {
+	return fs.size
+}
+func (fs *fileInfo) Sys() interface{} {
+	return fs.sys
+}
+
+// compactInfo is an implementation of os.FileInfo that only keeps what's
+// needed to find changes to a file, which is used by SetCompactState.
+type compactInfo struct {
+	name    string
+	modTime int64
+	size    int64
+	mode    uint32
+	ino     uint64 // 0 if not known.
+	dev     uint64 // 0 if not known.
+}
+
+// compactList replaces the os.FileInfo of each of the files in list with a
+// compactInfo.
+func compactList(list map[string]os.FileInfo) {
+	for path, info := range list {
+		if _, ok := info.(*compactInfo); ok {
+			continue
+		}
+		ino, _ := inode(info)
+		dev, _ := device(info)
+		list[path] = &compactInfo{
+			name:    filepath.Base(path), // shares path's memory.
+			modTime: info.ModTime().UnixNano(),
+			size:    info.Size(),
+			mode:    uint32(info.Mode()),
+			ino:     ino,
+			dev:     dev,
+		}
+	}
+}
+
+func (c *compactInfo) IsDir() bool {
+	return c.Mode().IsDir()
+}
+func (c *compactInfo) ModTime() time.Time {
+	return time.Unix(0, c.modTime)
+}
+func (c *compactInfo) Mode() os.FileMode {
+	return os.FileMode(c.mode)
+}
+func (c *compactInfo) Name() string {
+	return c.name
+}
+func (c *compactInfo) Size() int64 {
+	return c.size
+}
+func (c *compactInfo) Sys() interface{} {
+	return nil
+}
+
+// SetCompactState sets whether the watcher only keeps the modification
+// time, size, mode, inode and device of each watched file, instead of
+// everything that was found out about it, which saves memory when watching
+// enormous trees. On Linux, BenchmarkCompactState measures the memory kept
+// for each file, including its path, going from about 340 bytes to about
+// 195, which is over 40% less. The os.FileInfo of events and of WatchedFiles
+// are then made up from what's kept, so Sys returns nil. Ctimes and link
+// counts aren't kept, so SetUseCtime and SetWatchNlink have no effect while
+// files are compacted. Files are compacted when they're next listed.
+func (w *Watcher) SetCompactState(compact bool) {
+	w.mu.Lock()
+	w.compactState = compact
+	w.mu.Unlock()
+}
+
+// TriggerEvent is a method that can be used to trigger an event, separate to
+// the file watching process.
+func (w *Watcher) TriggerEvent(eventType Op, file os.FileInfo) {
+	w.Wait()
+	w.Event <- w.triggeredEvent(eventType, file)
+}
+
+// TriggerEventWait is like TriggerEvent, but it stops waiting for the
+// watcher to start and for the event to be received once ctx is done, in
+// which case ctx's error is returned. ErrClosed is returned if the watcher
+// closes before the event is received.
+func (w *Watcher) TriggerEventWait(ctx context.Context, eventType Op, file os.FileInfo) error {
+	// Waiting on w.started rather than w.Wait leaves nothing blocked
+	// behind if ctx is done before the watcher starts.
+	w.mu.Lock()
+	started, closed := w.started, w.Closed
+	w.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-started:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-closed:
+		return ErrClosed
+	case w.Event <- w.triggeredEvent(eventType, file):
+		return nil
+	}
+}
+
+// WaitFor receives events until one that match returns true for is found and
+// returns it. Errors received meanwhile are returned, as is ctx's error if ctx
+// is done first and ErrClosed if the watcher closes first.
+//
+// WaitFor receives from the Event and Error channels itself, so it must be
+// the only thing receiving from them while it's waiting.
+func (w *Watcher) WaitFor(ctx context.Context, match func(Event) bool) (Event, error) {
+	closed := w.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-closed:
+			return Event{}, ErrClosed
+		case err := <-w.Error:
+			return Event{}, err
+		case event := <-w.Event:
+			if match(event) {
+				return event, nil
+			}
+		}
+	}
+}
+
+// WaitForPath blocks until path exists, checking its directory for changes
+// every interval, and returns nil once it does. If ctx is done first, ctx's
+// error is returned. The directory that path is in must already exist.
+func WaitForPath(ctx context.Context, path string, interval time.Duration) error {
+	if interval < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w := New()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	// Check for path after starting to watch its directory, so that it
+	// can't be created in between without being noticed.
+	exists := func(Event) bool {
+		_, err := os.Stat(extendedPath(path))
+		return err == nil
+	}
+	if exists(Event{}) {
+		return nil
+	}
+
+	// Start only returns before it's started if it fails.
+	started := w.started
+	failed := make(chan error, 1)
+	go func() {
+		failed <- w.Start(interval)
+	}()
+	defer w.Close()
+	select {
+	case err := <-failed:
+		return err
+	case <-started:
+	}
+
+	_, err = w.WaitFor(ctx, exists)
+	return err
+}
+
+// triggeredEvent returns the event sent by TriggerEvent.
+func (w *Watcher) triggeredEvent(eventType Op, file os.FileInfo) Event {
+	w.mu.Lock()
+	now := w.clock.Now()
+	w.mu.Unlock()
+
+	if file == nil {
+		file = &fileInfo{name: "triggered event", modTime: now}
+	}
+	return Event{Op: eventType, Path: "-", FileInfo: file, EmittedAt: now}
+}
+
+func (w *Watcher) retrieveFileList() map[string]os.FileInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	fileList := make(map[string]os.FileInfo)
+	now := w.clock.Now()
+	w.scanErrors = nil
+
+	// Names below recursively watched directories are listed
+	// along with those directories. Names that aren't due to be
+	// listed yet keep the files found last time.
+	var names []string
+	for name := range w.names {
+		if w.covered(name) {
+			continue
+		}
+		if list, ok := w.scheduled(name, now); ok {
+			for k, v := range list {
+				fileList[k] = v
+			}
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Handle the results in the same order however many goroutines
+	// listed them.
+	for i, result := range w.scan(names) {
+		name := names[i]
+
+		// Files skipped because of permission errors were reported
+		// when they were added.
+		if skipped, ok := result.err.(*MultiError); ok {
+			w.scanErrors = append(w.scanErrors, skipped.errs...)
+			result.err = nil
+		}
+		if err := result.err; err != nil {
+			w.scanErrors = append(w.scanErrors, err)
+			if os.IsNotExist(err) {
+				w.mu.Unlock()
+				if name == cleanPath(err.(*os.PathError).Path) {
+					w.Error <- ErrWatchedFileDeleted
+					if result.recursive {
+						w.RemoveRecursive(name)
+					} else {
+						w.Remove(name)
+					}
+				}
+				w.mu.Lock()
+			} else {
+				w.Error <- err
+			}
+		}
+		for path := range result.pruned {
+			w.pruned[path] = struct{}{}
+		}
+		if w.compactState {
+			compactList(result.list)
+		}
+		if s, found := w.schedules[name]; found {
+			s.due = now.Add(s.interval)
+			s.files = result.list
+		}
+		// Add the file's to the file list.
+		for k, v := range result.list {
+			fileList[k] = v
+		}
+	}
+
+	// Forget about any pruned directories that no longer exist.
+	for path := range w.pruned {
+		if _, found := fileList[path]; !found {
+			delete(w.pruned, path)
+		}
+	}
+
+	return fileList
+}
+
+// Clock is a source of time for a watcher. It can be replaced using SetClock
+// so that tests can control the passing of time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker sends the time on a channel at intervals, like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// scanResult is the result of listing one of the watched names.
+type scanResult struct {
+	list      map[string]os.FileInfo
+	err       error
+	recursive bool
+	pruned    map[string]struct{} // new directories that weren't descended into.
+}
+
+// scan lists each of names, using up to scanConcurrency goroutines at
+// once, which the names and the directories below the recursively watched
+// ones are spread across. Listing only reads the watcher's state, so it's
+// safe to do while holding w.mu. The results are in the same order as names.
+func (w *Watcher) scan(names []string) []scanResult {
+	results := make([]scanResult, len(names))
+
+	// This goroutine counts as one of them.
+	var sem chan struct{}
+	if w.scanConcurrency > 1 {
+		sem = make(chan struct{}, w.scanConcurrency-1)
+	}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		i, name := i, name
+		if !spread(sem, &wg, func() { results[i] = w.scanName(name, sem) }) {
+			results[i] = w.scanName(name, sem)
+		}
+	}
+	wg.Wait()
+
+	return results
+}
+
+// spread calls f on a new goroutine added to wg if one of sem's slots is
+// free, and reports whether it did. If sem is nil, it never does.
+func spread(sem chan struct{}, wg *sync.WaitGroup, f func()) bool {
+	select {
+	case sem <- struct{}{}:
+	default:
+		return false
+	}
+	wg.Add(1)
+	go func() {
+		defer func() {
+			<-sem
+			wg.Done()
+		}()
+		f()
+	}()
+	return true
+}
+
+// scanName lists the watched name, recursively if it was added that way,
+// spreading the work across sem's slots.
+func (w *Watcher) scanName(name string, sem chan struct{}) scanResult {
+	result := scanResult{recursive: w.names[name]}
+	if result.recursive {
+		result.pruned = make(map[string]struct{})
+		result.list, result.err = w.listRecursive(name, result.pruned, sem)
+	} else {
+		result.list, result.err = w.list(name)
+	}
+	return result
+}
+
+// SetScanConcurrency sets how many goroutines list the watched files each
+// cycle, which the watched names and the directories below recursively
+// watched ones are spread across, so that statting files at once can help
+// when it's slow, even for a single tree. The default is 1. When n is more than 1, filter hooks and ignore
+// matchers must be safe to call from multiple goroutines at once. Events
+// are the same whatever n is.
+func (w *Watcher) SetScanConcurrency(n int) {
+	w.mu.Lock()
+	w.scanConcurrency = n
+	w.mu.Unlock()
+}
+
+// realClock is the Clock used by default, which uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// SetClock sets the clock used for the polling interval and all of the time
+// based settings. It must be called before Start. If clock is nil, the
+// real time is used, which is the default.
+func (w *Watcher) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	w.mu.Lock()
+	w.clock = clock
+	w.mu.Unlock()
+}
+
+// Start begins the polling cycle which repeats every specified
+// duration until Close is called. If d is 0, the interval set by
+// NewWithConfig is used.
+func (w *Watcher) Start(d time.Duration) error {
+	if d == 0 {
+		w.mu.Lock()
+		d = w.configured
+		w.mu.Unlock()
+	}
+
+	// Return an error if d is less than 1 nanosecond.
+	if d < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	// Make sure the Watcher is not already running.
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return ErrWatcherRunning
+	}
+	if w.state == Closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if len(w.files) == 0 && !w.allowEmpty {
+		w.mu.Unlock()
+		return ErrNothingWatched
+	}
+	w.running = true
+	notify := w.setState(Running)
+	w.sentFirstEvent = false
+	w.lastActivity = w.clock.Now()
+	started := w.lastActivity
+	w.nextCompact = started.Add(w.compactInterval)
+	for _, dl := range w.deadlines {
+		dl.written, dl.reported = started, false
+	}
+	w.interval = d
+	w.lastCycle = time.Time{}
+	ticker := w.clock.NewTicker(d)
+	var expiry Ticker
+	w.expired = nil
+	if w.maxRunTime > 0 {
+		expiry = w.clock.NewTicker(w.maxRunTime)
+		w.expired = expiry.C()
+	}
+	w.mu.Unlock()
+	notify()
+
+	defer func() {
+		ticker.Stop()
+		if expiry != nil {
+			expiry.Stop()
+		}
+	}()
+
+	// Silently record how the files are when starting if needed.
+	w.mu.Lock()
+	ignorePreexisting := w.ignorePreexisting
+	w.mu.Unlock()
+	if ignorePreexisting {
+		fileList := w.retrieveFileList()
+		w.mu.Lock()
+		w.pollEvents(fileList)
+		w.files = fileList
+		w.mu.Unlock()
+	}
+
+	// Unblock w.Wait().
+	w.mu.Lock()
+	close(w.started)
+	w.mu.Unlock()
+	w.wg.Done()
+
+	for cycle := uint64(1); ; cycle++ {
+		w.mu.Lock()
+		tickHook := w.tickHook
+		w.mu.Unlock()
+		if tickHook != nil {
+			tickHook(cycle)
+		}
+
+		w.mu.Lock()
+		cycleStart := w.clock.Now()
+		w.lastCycle = cycleStart
+		w.mu.Unlock()
+
+		// Retrieve the file list for all watched file's and dirs.
+		fileList := w.retrieveFileList()
+		if cycle == 1 {
+			w.reportScan(len(fileList), cycleStart)
+		}
+
+		// Look for events, queue them up for sending and then
+		// update the file's list.
+		w.mu.Lock()
+		events := w.pollEvents(fileList)
+		w.meetDeadlines(events)
+		w.invalidateChecksums(events)
+		events = w.stabilize(events)
+		reminders := w.remind(events, fileList)
+		events = append(w.selectEvents(events), w.selectReminders(reminders)...)
+		w.queue = w.deferEvents(w.window(w.rewriteEvents(w.coalesce(events, fileList)), fileList))
+		w.queue = append(w.queue, w.staleEvents()...)
+		w.adaptInterval(len(w.queue) > 0)
+		massChange := w.massChange(len(w.files), len(fileList))
+		w.files = fileList
+		lagging := w.lagged(w.clock.Now().Sub(cycleStart), w.interval)
+		compacting := w.compactInterval > 0 && !w.clock.Now().Before(w.nextCompact)
+		unverified := w.takeUnverified()
+		w.mu.Unlock()
+
+		for _, err := range verifyChecksums(unverified) {
+			if !w.sendError(err) {
+				w.finish()
+				return nil
+			}
+		}
+
+		if massChange && !w.sendError(ErrMassChange) {
+			w.finish()
+			return nil
+		}
+		if lagging && !w.sendError(ErrPollLagging) {
+			w.finish()
+			return nil
+		}
+		if compacting && w.compact() > 0 && !w.sendError(ErrDrift) {
+			w.finish()
+			return nil
+		}
+
+		if err := w.sendQueued(); err != nil {
+			w.end(err)
+			return nil
+		}
+		if cycle == 1 {
+			w.markSynced()
+		}
+
+		// Stop if no events have been sent for the idle timeout, if one
+		// has been sent and only one should be, or if the watcher has
+		// run for long enough.
+		w.mu.Lock()
+		idle := w.idleTimeout > 0 && w.clock.Now().Sub(w.lastActivity) >= w.idleTimeout
+		finished := w.stopAfterFirstEvent && w.sentFirstEvent
+		expired := w.maxRunTime > 0 && w.clock.Now().Sub(started) >= w.maxRunTime
+		w.mu.Unlock()
+		if idle || finished || expired {
+			w.stop()
+			return nil
+		}
+
+		// Wait for the next tick and then continue to the next loop iteration.
+		var err error
+		if ticker, err = w.nextTick(ticker); err != nil {
+			w.end(err)
+			return nil
+		}
+	}
+}
+
+// errExpired occurs when the watcher has run for as long as SetMaxRunTime
+// allows while sending events or waiting for the next tick.
+var errExpired = errors.New("error: watcher ran for its max run time")
+
+// end makes Start finish after sending events or waiting for the next tick
+// was stopped by err, closing the watcher first if it ran out of time
+// rather than being closed.
+func (w *Watcher) end(err error) {
+	if err == errExpired {
+		w.stop()
+		return
+	}
+	w.finish()
+}
+
+// A ScanResult describes how the first scan of the watched files went after
+// the watcher started.
+type ScanResult struct {
+	FilesWatched int           // the number of files and directories found.
+	Errors       []error       // the errors that occurred while listing them.
+	Duration     time.Duration // how long listing them took.
+}
+
+// SetInitialScanReport sets a function that's called once each time the
+// watcher starts, after the first polling cycle has listed the watched files,
+// with a summary of how it went. The errors in the summary are also sent on
+// the Error channel as usual, except for the files skipped because of
+// SetSkipPermissionErrors, which are only reported here.
+func (w *Watcher) SetInitialScanReport(report func(result ScanResult)) {
+	w.mu.Lock()
+	w.scanReport = report
+	w.mu.Unlock()
+}
+
+// reportScan calls the function set with SetInitialScanReport, if any, with
+// the result of the scan that found files files and started at start.
+func (w *Watcher) reportScan(files int, start time.Time) {
+	w.mu.Lock()
+	report := w.scanReport
+	result := ScanResult{
+		FilesWatched: files,
+		Errors:       w.scanErrors,
+		Duration:     w.clock.Now().Sub(start),
+	}
+	w.mu.Unlock()
+
+	if report != nil {
+		report(result)
+	}
+}
+
+// InitialSyncDone returns a channel that's closed once the events found by
+// the first polling cycle after the watcher starts have been received, so
+// that the changes made before then can be told apart from the ones made
+// while the watcher was running. Events held back for later cycles, such as
+// by SetMaxEventsPerCycle or SetActiveWindow, can still be sent after it's
+// closed. Reset replaces the channel.
+func (w *Watcher) InitialSyncDone() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.synced
+}
+
+// markSynced closes the channel returned by InitialSyncDone, unless it
+// already was.
+func (w *Watcher) markSynced() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.synced:
+	default:
+		close(w.synced)
+	}
+}
+
+// nextTick waits for ticker to tick, replacing it whenever the interval
+// changes. It returns the ticker to use from then on, and ErrClosed or
+// errExpired if the watcher was closed or ran out of time first.
+func (w *Watcher) nextTick(ticker Ticker) (Ticker, error) {
+	w.mu.Lock()
+	expired := w.expired
+	w.mu.Unlock()
+
+	for {
+		select {
+		case <-w.close:
+			return ticker, ErrClosed
+		case <-expired:
+			return ticker, errExpired
+		case <-w.intervalChanged:
+			w.mu.Lock()
+			ticker.Stop()
+			ticker = w.clock.NewTicker(w.interval)
+			w.mu.Unlock()
+		case <-ticker.C():
+			// Don't check for changes while paused.
+			w.mu.Lock()
+			paused := w.state == Paused
+			w.mu.Unlock()
+			if paused {
+				continue
+			}
+			return ticker, nil
+		}
+	}
+}
+
+// SetInterval changes how often a running watcher checks for changes. The
+// next check happens d after the interval is changed. It returns
+// ErrDurationTooShort if d is less than 1 nanosecond.
+func (w *Watcher) SetInterval(d time.Duration) error {
+	if d < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	w.mu.Lock()
+	w.setInterval(d)
+	w.mu.Unlock()
+
+	return nil
+}
+
+// WithInterval changes how often a running watcher checks for changes to d
+// while fn runs, such as to check less often while fn changes lots of files,
+// and then changes it back. The interval isn't adapted by
+// SetAdaptiveInterval while fn runs. It returns ErrDurationTooShort without
+// calling fn if d is less than 1 nanosecond.
+func (w *Watcher) WithInterval(d time.Duration, fn func()) error {
+	if d < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	w.mu.Lock()
+	previous := w.interval
+	w.setInterval(d)
+	w.pinned++
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.pinned--
+		// The watcher wasn't running if there was no interval.
+		if previous > 0 {
+			w.setInterval(previous)
+		}
+		w.mu.Unlock()
+	}()
+
+	fn()
+	return nil
+}
+
+// SetAdaptiveInterval makes a running watcher check for changes less often
+// while nothing changes, to save power when it's idle. After each polling
+// cycle that finds no events to send, the interval is doubled, up to max,
+// and after each one that does, it goes straight back to min. The tradeoff
+// is that the first change after an idle period can take up to max to be
+// found, but the changes after it are found every min again. The interval
+// passed to Start is used until the end of the first cycle, and SetInterval
+// only changes it until the end of the next one, but the interval set by
+// WithInterval is kept until its function returns, and then adapted from the
+// interval before it. It returns
+// ErrDurationTooShort if min is less than 1 nanosecond. If max isn't greater
+// than min, the interval isn't adapted, which is the default.
+func (w *Watcher) SetAdaptiveInterval(min, max time.Duration) error {
+	if max > min && min < time.Nanosecond {
+		return ErrDurationTooShort
+	}
+
+	w.mu.Lock()
+	w.minInterval, w.maxInterval = min, max
+	w.mu.Unlock()
+
+	return nil
+}
+
+// adaptInterval backs the interval off after a cycle that found no events to
+// send, and resets it after one that did.
+func (w *Watcher) adaptInterval(found bool) {
+	if w.maxInterval <= w.minInterval || w.pinned > 0 {
+		return
+	}
+	d := w.minInterval
+	if !found {
+		d = w.interval * 2
+		if d < w.minInterval {
+			d = w.minInterval
+		}
+		if d > w.maxInterval {
+			d = w.maxInterval
+		}
+	}
+	if d != w.interval {
+		w.setInterval(d)
+	}
+}
+
+// setInterval sets the interval and lets Start know that it changed.
+func (w *Watcher) setInterval(d time.Duration) {
+	w.interval = d
+	select {
+	case w.intervalChanged <- struct{}{}:
+	default:
+	}
+}
+
+// SetSlashPaths sets whether the Path and OldPath of events use forward
+// slashes as separators on every platform, such as on Windows, where they
+// use backslashes by default. Paths are converted after being rewritten by
+// SetPathRewrite.
+func (w *Watcher) SetSlashPaths(slash bool) {
+	w.mu.Lock()
+	w.slashPaths = slash
+	w.mu.Unlock()
+}
+
+// SetPathRewrite makes the watcher replace matches of pattern in the Path and
+// OldPath of events with replacement, as regexp.ReplaceAllString does, before
+// they're sent. This can map resolved paths, such as the targets of symlinks,
+// back to the paths that a receiver expects. The event transformer, if any,
+// is called with the rewritten event. If pattern is nil, paths are sent as
+// they are, which is the default.
+func (w *Watcher) SetPathRewrite(pattern *regexp.Regexp, replacement string) {
+	w.mu.Lock()
+	w.rewrite = pattern
+	w.replacement = replacement
+	w.mu.Unlock()
+}
+
+// SetAllowEmpty sets whether Start can be called before any files or
+// directories have been added, such as when they're added after starting.
+// By default, Start returns ErrNothingWatched instead.
+func (w *Watcher) SetAllowEmpty(allow bool) {
+	w.mu.Lock()
+	w.allowEmpty = allow
+	w.mu.Unlock()
+}
+
+// SetTickHook sets a function that's called at the start of every polling
+// cycle, whether or not anything changed, with the number of the cycle
+// since Start was called, starting from 1. It's called from the goroutine
+// that Start was called from, so changes aren't looked for until it returns,
+// but unlike filter hooks, it can call the watcher's methods, such as Close.
+func (w *Watcher) SetTickHook(f func(cycle uint64)) {
+	w.mu.Lock()
+	w.tickHook = f
+	w.mu.Unlock()
+}
+
+// SetStopAfterFirstEvent sets whether the watcher closes itself as soon as
+// the first event it finds has been received from the Event channel, after
+// which Start returns nil. No other events are sent, even if more were found
+// during the same cycle.
+func (w *Watcher) SetStopAfterFirstEvent(stop bool) {
+	w.mu.Lock()
+	w.stopAfterFirstEvent = stop
+	w.mu.Unlock()
+}
+
+// SetIgnorePreexisting sets whether changes made before Start is called are
+// ignored. By default, files are compared against how they were when they
+// were added, so files that changed between being added and Start being
+// called cause events during the first cycle. Otherwise, files are compared
+// against how they are when Start is called, and only changes made after that
+// cause events.
+func (w *Watcher) SetIgnorePreexisting(ignore bool) {
+	w.mu.Lock()
+	w.ignorePreexisting = ignore
+	w.mu.Unlock()
+}
+
+// SetEventTransformer sets a function that's called with every event after
+// it passes all of the filters and before it's sent. The event that it
+// returns is sent instead, unless it returns false, in which case nothing
+// is sent. Like filter hooks, it must not call any of the watcher's methods.
+func (w *Watcher) SetEventTransformer(f func(Event) (Event, bool)) {
+	w.mu.Lock()
+	w.transformer = f
+	w.mu.Unlock()
+}
+
+// SetCollapseCreateWrite sets whether a Write event for a file is dropped
+// when the file's Create event is sent during the same cycle, so that only
+// the Create event is sent. Writes in later cycles are still sent.
+func (w *Watcher) SetCollapseCreateWrite(collapse bool) {
+	w.mu.Lock()
+	w.collapseCreateWrite = collapse
+	w.mu.Unlock()
+}
+
+// SetPathAlias makes events for any of the aliases paths be sent as events
+// for the canonical path instead. At most one event per cycle is sent for
+// the canonical path and its aliases, so saving a file by writing to a
+// temporary file and renaming it over the original causes a single event.
+func (w *Watcher) SetPathAlias(canonical string, aliases ...string) error {
+	canonical, err := filepath.Abs(canonical)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{canonical}
+	for _, alias := range aliases {
+		alias, err := filepath.Abs(alias)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, alias)
+	}
+
+	w.mu.Lock()
+	for _, path := range paths {
+		w.aliases[path] = canonical
+	}
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SetDistinctDirOps sets whether directories that are created or removed
+// cause DirCreate and DirRemove events instead of Create and Remove events.
+func (w *Watcher) SetDistinctDirOps(distinct bool) {
+	w.mu.Lock()
+	w.distinctDirOps = distinct
+	w.mu.Unlock()
+}
+
+// SetWatchSetDeltaThreshold makes the watcher send ErrMassChange on the Error
+// channel whenever the number of watched files changes by more than n in a
+// single cycle, which might call for a full rebuild instead of handling each
+// event. If n is less than 1, which is the default, ErrMassChange isn't sent.
+func (w *Watcher) SetWatchSetDeltaThreshold(n int) {
+	w.mu.Lock()
+	w.deltaThreshold = n
+	w.mu.Unlock()
+}
+
+// massChange reports whether the number of watched files changing from
+// before to after is more than the threshold.
+func (w *Watcher) massChange(before, after int) bool {
+	if w.deltaThreshold < 1 {
+		return false
+	}
+	delta := after - before
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta > w.deltaThreshold
+}
+
+// sendError sends err on the Error channel. It returns false if the
+// watcher was closed before err was received.
+func (w *Watcher) sendError(err error) bool {
+	select {
+	case <-w.close:
+		return false
+	case w.Error <- err:
+		return true
+	}
+}
+
+// SetCompactInterval makes the watcher compact its state every d, which is
+// checked once every polling cycle. Compacting copies the list of watched
+// files and the events waiting to be acknowledged into maps that are no
+// bigger than needed, leaving out events for files that are no longer
+// watched, so that long running watchers of trees with lots of churn give
+// back the memory that they no longer use. It also checks that each watched
+// file still exists, and sends ErrDrift on the Error channel if any don't.
+// If d is less than 1 nanosecond, the state is never compacted, which is the
+// default.
+func (w *Watcher) SetCompactInterval(d time.Duration) {
+	w.mu.Lock()
+	w.compactInterval = d
+	w.nextCompact = w.clock.Now().Add(d)
+	w.mu.Unlock()
+}
+
+// compact compacts the watcher's state and returns the number of watched
+// files that no longer exist.
+func (w *Watcher) compact() int {
+	w.mu.Lock()
+	files := make(map[string]os.FileInfo, len(w.files))
+	paths := make([]string, 0, len(w.files))
+	for path, info := range w.files {
+		files[path] = info
+		paths = append(paths, path)
+	}
+	w.files = files
+	unacked := make(map[string]unackedEvent, len(w.unacked))
+	for path, u := range w.unacked {
+		if _, found := files[path]; found {
+			unacked[path] = u
+		}
+	}
+	w.unacked = unacked
+	w.nextCompact = w.clock.Now().Add(w.compactInterval)
+	w.mu.Unlock()
+
+	missing := 0
+	for _, path := range paths {
+		if _, err := os.Lstat(extendedPath(path)); os.IsNotExist(err) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// SetLagWarning makes the watcher send ErrPollLagging on the Error channel
+// each time finding the changes takes longer than the polling interval for
+// consecutive cycles in a row. If consecutive is less than 1, no warning is
+// sent, which is the default.
+func (w *Watcher) SetLagWarning(consecutive int) {
+	w.mu.Lock()
+	w.lagWarning = consecutive
+	w.lagCycles = 0
+	w.mu.Unlock()
+}
+
+// lagged records whether a cycle that took elapsed fell behind the
+// polling interval d and reports whether a lag warning should be sent.
+func (w *Watcher) lagged(elapsed, d time.Duration) bool {
+	if w.lagWarning < 1 {
+		return false
+	}
+	if elapsed <= d {
+		w.lagCycles = 0
+		return false
+	}
+	w.lagCycles++
+	if w.lagCycles < w.lagWarning {
+		return false
+	}
+	w.lagCycles = 0
+	return true
+}
+
+// SetStableDelay makes the watcher hold back Create and Write events for
+// files until they haven't changed for d, and then send a single event
+// for them. The event is a Create event if the file was created since it
+// started changing, and a Write event otherwise. If d is less than 1
+// nanosecond, events are never held back, which is the default.
+func (w *Watcher) SetStableDelay(d time.Duration) {
+	w.mu.Lock()
+	w.stableDelay = d
+	w.mu.Unlock()
+}
+
+// unstableFile is a file whose event is being held back until the
+// file stops changing.
+type unstableFile struct {
+	event   Event
+	changed time.Time
+}
+
+// stabilize holds back the Create and Write events for files that are
+// still changing and returns the remaining events along with the events
+// for files that have become stable.
+func (w *Watcher) stabilize(events []Event) []Event {
+	if w.stableDelay <= 0 && len(w.unstable) == 0 {
+		return events
+	}
+
+	now := w.clock.Now()
+	kept := events[:0]
+	for _, event := range events {
+		held, found := w.unstable[event.Path]
+		switch {
+		case (event.Op == Create || event.Op == Write) && !event.IsDir() && w.stableDelay > 0:
+			if found {
+				// Keep the original op, but use the latest file info.
+				event.Op = held.event.Op
+			}
+			w.unstable[event.Path] = &unstableFile{event: event, changed: now}
+			continue
+		case event.Op == Remove && found:
+			delete(w.unstable, event.Path)
+			if held.event.Op == Create {
+				// The file came and went before it was stable.
+				continue
+			}
+		case event.Op == Rename || event.Op == Move:
+			delete(w.unstable, event.OldPath)
+		}
+		kept = append(kept, event)
+	}
+
+	// Send the events for files that have stopped changing.
+	var stable []string
+	for path, held := range w.unstable {
+		if now.Sub(held.changed) >= w.stableDelay {
+			stable = append(stable, path)
+		}
+	}
+	sort.Strings(stable)
+	for _, path := range stable {
+		kept = append(kept, w.unstable[path].event)
+		delete(w.unstable, path)
+	}
+
+	return kept
+}
+
+// filterEvents removes any events that shouldn't be sent from the
+// events found during a cycle, and rewrites the paths of the rest.
+func (w *Watcher) filterEvents(events []Event) []Event {
+	return w.rewriteEvents(w.selectEvents(events))
+}
+
+// selectEvents removes any events that shouldn't be sent from events.
+func (w *Watcher) selectEvents(events []Event) []Event {
+	// Find the files that were created during the cycle.
+	var created map[string]struct{}
+	if w.collapseCreateWrite {
+		created = make(map[string]struct{})
+		for _, event := range events {
+			if event.Op == Create {
+				created[event.Path] = struct{}{}
+			}
+		}
+	}
+
+	filtered := events[:0]
+	for _, event := range events {
+		if event.Op == Write {
+			if _, found := created[event.Path]; found {
+				continue
+			}
+		}
+		if event, ok := w.selectEvent(event, true); ok {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// selectReminders removes any of the events sent again by remind that
+// shouldn't be sent anymore, such as because their ops are now filtered.
+func (w *Watcher) selectReminders(events []Event) []Event {
+	filtered := events[:0]
+	for _, event := range events {
+		if event, ok := w.selectEvent(event, false); ok {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// selectEvent reports whether event should be sent, and returns it with its
+// Op and Root set. Write events only count towards SuppressNextWrite and
+// SetEventCountTrigger if fresh is set, for when they weren't sent before.
+func (w *Watcher) selectEvent(event Event, fresh bool) (Event, bool) {
+	if w.distinctDirOps && event.FileInfo != nil && event.IsDir() {
+		switch event.Op {
+		case Create:
+			event.Op = DirCreate
+		case Remove:
+			event.Op = DirRemove
+		}
+	}
+	if w.ops != nil { // Filter Ops.
+		if _, found := w.ops[event.Op]; !found {
+			return event, false
+		}
+	}
+	if !w.allowedOp(event) {
+		return event, false
+	}
+	if (event.Op == Write || event.Op == Chmod) && w.isShallow(event.Path) {
+		return event, false
+	}
+	if w.maxEventDepth > 0 && w.eventDepth(event.Path) > w.maxEventDepth {
+		return event, false
+	}
+	if _, root := w.names[event.Path]; root && w.ignoreRoots {
+		return event, false
+	}
+	if w.unmatched(event) {
+		return event, false
+	}
+	event.Root = w.rootOf(event.Path)
+	if !w.acceptEvent(event) {
+		return event, false
+	}
+	if fresh && event.Op == Write && w.suppressWrite(event.Path) {
+		return event, false
+	}
+	if fresh && event.Op == Write && !w.countWrite(event.Path) {
+		return event, false
+	}
+	return event, true
+}
+
+// rewriteEvents rewrites the paths of events to how they're sent, after
+// they've been filtered, and drops the events beyond SetMaxEvents' limit.
+func (w *Watcher) rewriteEvents(events []Event) []Event {
+	// Canonical paths of aliased paths that already have an event.
+	aliased := make(map[string]struct{})
+
+	rewritten := events[:0]
+	for _, event := range events {
+		source := event
+		if canonical, found := w.aliases[event.Path]; found {
+			if _, sent := aliased[canonical]; sent {
+				continue
+			}
+			aliased[canonical] = struct{}{}
+			event.Path = canonical
+			if _, found := w.aliases[event.OldPath]; found {
+				event.OldPath = canonical
+			}
+		}
+		if w.rewrite != nil {
+			event.Path = w.rewrite.ReplaceAllString(event.Path, w.replacement)
+			event.OldPath = w.rewrite.ReplaceAllString(event.OldPath, w.replacement)
+		}
+		if w.slashPaths {
+			event.Path = filepath.ToSlash(event.Path)
+			event.OldPath = filepath.ToSlash(event.OldPath)
+			event.Root = filepath.ToSlash(event.Root)
+		}
+		if event.children != nil && (w.rewrite != nil || w.slashPaths) {
+			children := make([]string, len(*event.children))
+			for i, child := range *event.children {
+				if w.rewrite != nil {
+					child = w.rewrite.ReplaceAllString(child, w.replacement)
+				}
+				if w.slashPaths {
+					child = filepath.ToSlash(child)
+				}
+				children[i] = child
+			}
+			event.children = &children
+		}
+		if w.transformer != nil {
+			var ok bool
+			if event, ok = w.transformer(event); !ok {
+				continue
+			}
+		}
+		if w.maxEvents > 0 && len(rewritten) == w.maxEvents {
+			break
+		}
+		if w.tracking() {
+			w.sources[event.Path] = source
+		}
+		rewritten = append(rewritten, event)
+	}
+	return rewritten
+}
+
+// rootOf returns the longest of the names added to the watcher that path is
+// or is below.
+func (w *Watcher) rootOf(path string) string {
+	var root string
+	for name := range w.names {
+		if (path == name || isUnder(path, name)) && len(name) > len(root) {
+			root = name
+		}
+	}
+	return root
+}
+
+// isShallow reports whether path is a directory added using AddShallow
+// or one of its entries.
+func (w *Watcher) isShallow(path string) bool {
+	if _, found := w.shallow[path]; found {
+		return true
+	}
+	_, found := w.shallow[filepath.Dir(path)]
+	return found
+}
+
+// SetIgnoreRoots sets whether events for the files and directories that were
+// added to the watcher themselves are dropped, such as a Chmod event for a
+// directory added with AddRecursive. Events for the files below them are
+// still sent.
+func (w *Watcher) SetIgnoreRoots(ignore bool) {
+	w.mu.Lock()
+	w.ignoreRoots = ignore
+	w.mu.Unlock()
+}
+
+// SetMaxEventDepth stops events from being sent for files more than n levels
+// of directories below the file or directory they're watched as part of,
+// where n is 1 for the contents of a watched directory. The files are still
+// watched, unlike when limiting the depth with AddPaths. If n is less than
+// 1, which is the default, events are sent however deep files are.
+func (w *Watcher) SetMaxEventDepth(n int) {
+	w.mu.Lock()
+	w.maxEventDepth = n
+	w.mu.Unlock()
+}
+
+// eventDepth returns how many levels of directories path is below the
+// closest watched name that it's below, or 0 if it's not below any.
+func (w *Watcher) eventDepth(path string) int {
+	depth := 0
+	for name := range w.names {
+		if path == name {
+			return 0
+		}
+		if isUnder(path, name) {
+			if d := depthBelow(path, name); depth == 0 || d < depth {
+				depth = d
+			}
+		}
+	}
+	return depth
+}
+
+// allowedOp reports whether the filter hooks that limit ops allowed the op
+// of event when its file was last listed. The ops of files that are gone
+// are forgotten.
+func (w *Watcher) allowedOp(event Event) bool {
+	// Every hook is asked, so that each forgets the ops of files that
+	// are gone.
+	allowed := true
+	for _, h := range w.opsHooks {
+		if !h.allows(event) {
+			allowed = false
+		}
+	}
+	return allowed
+}
+
+// save saves the ops of path, and returns a function that puts them back.
+func (h *opsHook) save(path string) func() {
+	h.mu.Lock()
+	ops, found := h.ops[path]
+	h.mu.Unlock()
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if found {
+			h.ops[path] = ops
+		} else {
+			delete(h.ops, path)
+		}
+	}
+}
+
+// allows reports whether h allows the op of event.
+func (h *opsHook) allows(event Event) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ops, found := h.ops[event.Path]
+	switch event.Op {
+	case Remove:
+		delete(h.ops, event.Path)
+	case Rename, Move:
+		delete(h.ops, event.OldPath)
+	}
+	if !found {
+		return true
+	}
+	for _, op := range ops {
+		if op == event.Op {
+			return true
+		}
+	}
+	return false
+}
+
+// countTrigger counts the writes of a path set with SetEventCountTrigger.
+type countTrigger struct {
+	n    int
+	seen int
+}
+
+// SetEventCountTrigger makes only every nth Write event for path be sent.
+// The first n-1 are dropped and the nth is sent, after which counting starts
+// over. If n is less than 2, every Write event for path is sent again, which
+// is the default.
+func (w *Watcher) SetEventCountTrigger(path string, n int) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n < 2 {
+		delete(w.countTriggers, path)
+		return nil
+	}
+	w.countTriggers[path] = &countTrigger{n: n}
+	return nil
+}
+
+// countWrite counts a Write event for path and reports whether it should
+// be sent.
+func (w *Watcher) countWrite(path string) bool {
+	t, found := w.countTriggers[path]
+	if !found {
+		return true
+	}
+	t.seen++
+	if t.seen < t.n {
+		return false
+	}
+	t.seen = 0
+	return true
+}
+
+// SuppressNextWrite makes the next Write event for path not be sent, which is
+// useful right before writing to a watched file. Only that one event is
+// dropped, however long it takes for it to happen, and later ones are sent
+// as usual. Calling it again before then still only drops one event.
+func (w *Watcher) SuppressNextWrite(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.suppressed[path] = struct{}{}
+	w.mu.Unlock()
+	return nil
+}
+
+// suppressWrite reports whether a Write event for path should be dropped
+// because of SuppressNextWrite, and stops suppressing them if so.
+func (w *Watcher) suppressWrite(path string) bool {
+	if _, found := w.suppressed[path]; !found {
+		return false
+	}
+	delete(w.suppressed, path)
+	return true
+}
+
+// acceptEvent runs the event filter hooks for event.
+func (w *Watcher) acceptEvent(event Event) bool {
+	for _, f := range w.efh {
+		if !f(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetMaxEventsPerCycle limits the events sent on the Event channel per
+// watching cycle to n. Unlike SetMaxEvents, which drops any events beyond
+// its limit, the excess events are sent during the following cycles in the
+// order they were found. When both are set, SetMaxEvents drops events from
+// each cycle's newly found events first. If n is less than 1, there is no
+// limit, which is the default.
+func (w *Watcher) SetMaxEventsPerCycle(n int) {
+	w.mu.Lock()
+	w.maxEventsPerCycle = n
+	w.mu.Unlock()
+}
+
+// deadline is how often a path set with SetStaleDeadline has to be written to.
+type deadline struct {
+	d        time.Duration
+	written  time.Time // when the path was last written to.
+	reported bool      // whether a Stale event was sent since then.
+}
+
+// SetStaleDeadline makes the watcher send a Stale event for path if it isn't
+// created or written to for d, which is checked once every polling cycle.
+// After that, another Stale event is only sent once it has been written to
+// again and then not for d. Time is counted from when the watcher is started
+// or, if it's already running, from when the deadline is set. Stale events
+// aren't filtered like the events of changes are. If d is less than 1
+// nanosecond, no deadline is kept for path, which is the default.
+func (w *Watcher) SetStaleDeadline(path string, d time.Duration) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if d < time.Nanosecond {
+		delete(w.deadlines, path)
+		return nil
+	}
+	w.deadlines[path] = &deadline{d: d, written: w.clock.Now()}
+	return nil
+}
+
+// meetDeadlines records when the paths with deadlines were written to.
+func (w *Watcher) meetDeadlines(events []Event) {
+	if len(w.deadlines) == 0 {
+		return
+	}
+	now := w.clock.Now()
+	for _, event := range events {
+		if event.Op != Create && event.Op != Write {
+			continue
+		}
+		if dl, found := w.deadlines[event.Path]; found {
+			dl.written, dl.reported = now, false
+		}
+	}
+}
+
+// staleEvents returns Stale events for the paths with deadlines that haven't
+// been written to in time, ordered by path.
+func (w *Watcher) staleEvents() []Event {
+	var events []Event
+	now := w.clock.Now()
+	for path, dl := range w.deadlines {
+		if dl.reported || now.Sub(dl.written) < dl.d {
+			continue
+		}
+		dl.reported = true
+		event := Event{Op: Stale, Path: path, OldPath: path}
+		if info, found := w.files[path]; found {
+			event.FileInfo = info
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Path < events[j].Path })
+	return events
+}
+
+// A ChecksumError is sent on the Error channel when the contents of a file
+// in the manifest set with SetChecksumManifest don't have the expected
+// checksum, or when the file doesn't exist. It wraps ErrChecksumMismatch.
+type ChecksumError struct {
+	Path     string // the file's path.
+	Expected string // the checksum from the manifest.
+	Actual   string // the checksum of the file's contents, or "" if it's missing.
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("%s: %s is missing, expected checksum %s", ErrChecksumMismatch, e.Path, e.Expected)
+	}
+	return fmt.Sprintf("%s: %s has checksum %s, expected %s", ErrChecksumMismatch, e.Path, e.Actual, e.Expected)
+}
+
+// Unwrap returns ErrChecksumMismatch.
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// SetChecksumManifest sets the expected SHA-256 checksums of files, as hex
+// strings keyed by path, replacing any set before. The watched files in the
+// manifest are checked during the next polling cycle and again whenever
+// they're created or written to, and a *ChecksumError is sent on the Error
+// channel for each one whose contents don't match. A *ChecksumError is also
+// sent for each file in the manifest that doesn't exist, then and whenever
+// it's removed, renamed or moved. Other files that aren't watched, or that
+// can't be read, aren't checked.
+func (w *Watcher) SetChecksumManifest(manifest map[string]string) error {
+	checksums := make(map[string]string, len(manifest))
+	for path, sum := range manifest {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		checksums[path] = strings.ToLower(sum)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.checksums = checksums
+	w.unverified = make(map[string]struct{}, len(checksums))
+	for path := range checksums {
+		w.unverified[path] = struct{}{}
+	}
+	return nil
+}
+
+// invalidateChecksums marks the files in the manifest that were created,
+// written to, removed, renamed or moved as needing their checksums checked.
+func (w *Watcher) invalidateChecksums(events []Event) {
+	if len(w.checksums) == 0 {
+		return
+	}
+	for _, event := range events {
+		var paths []string
+		switch event.Op {
+		case Create, Write, Remove, Rotated:
+			paths = []string{event.Path}
+		case Rename, Move:
+			paths = []string{event.OldPath, event.Path}
+		}
+		for _, path := range paths {
+			if _, found := w.checksums[path]; found {
+				w.unverified[path] = struct{}{}
+			}
+		}
+	}
+}
+
+// takeUnverified returns the expected checksums of the watched files that
+// need checking and of the files that are missing, and marks them as
+// checked. Files that exist but aren't watched are checked once they are.
+func (w *Watcher) takeUnverified() map[string]string {
+	if len(w.unverified) == 0 {
+		return nil
+	}
+	unverified := make(map[string]string)
+	for path := range w.unverified {
+		info, found := w.files[path]
+		if found && info.IsDir() {
+			continue
+		}
+		if _, err := os.Lstat(extendedPath(path)); !found && !os.IsNotExist(err) {
+			continue
+		}
+		unverified[path] = w.checksums[path]
+		delete(w.unverified, path)
+	}
+	return unverified
+}
+
+// verifyChecksums returns a *ChecksumError, ordered by path, for each file
+// whose contents don't have the expected checksum or that's missing.
+func verifyChecksums(expected map[string]string) []error {
+	paths := make([]string, 0, len(expected))
+	for path := range expected {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var errs []error
+	for _, path := range paths {
+		sum, err := checksum(path)
+		if os.IsNotExist(err) {
+			errs = append(errs, &ChecksumError{Path: path, Expected: expected[path]})
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sum != expected[path] {
+			errs = append(errs, &ChecksumError{Path: path, Expected: expected[path], Actual: sum})
+		}
+	}
+	return errs
+}
+
+// checksum returns the SHA-256 checksum of the contents of the file at path
+// as a hex string.
+func checksum(path string) (string, error) {
+	f, err := os.Open(extendedPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SetActiveWindow makes the watcher only send events between the times of
+// day start and end, such as 9 and 17 hours for business hours, in the
+// clock's local time. If start is after end, the window spans midnight.
+// Changes are still found outside of the window, but events for them are
+// held back, and once the window opens, a summary of them is sent instead,
+// made up of the events that describe the changes between the files that
+// were listed when the window closed and the ones listed when it opens, as
+// if nothing was listed in between. A file that's removed and created again
+// only causes the events of how it differs, and one that's created and
+// removed again causes none. If start and end are equal, events are always
+// sent, which is the default.
+func (w *Watcher) SetActiveWindow(start, end time.Duration) {
+	w.mu.Lock()
+	w.windowStart, w.windowEnd = start, end
+	w.mu.Unlock()
+}
+
+// active reports whether now is within the active window.
+func (w *Watcher) active(now time.Time) bool {
+	if w.windowStart == w.windowEnd {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	t := now.Sub(midnight)
+	if w.windowStart < w.windowEnd {
+		return t >= w.windowStart && t < w.windowEnd
+	}
+	return t >= w.windowStart || t < w.windowEnd
+}
+
+// window holds back events outside of the active window. Once it opens, it
+// returns the events that were deferred when it closed, followed by the
+// summary of the changes from the files listed then to files, instead of
+// events.
+func (w *Watcher) window(events []Event, files map[string]os.FileInfo) []Event {
+	if !w.active(w.clock.Now()) {
+		if w.closedFiles == nil {
+			w.closedFiles = make(map[string]os.FileInfo, len(w.files))
+			for path, info := range w.files {
+				w.closedFiles[path] = info
+			}
+			w.missed, w.deferred = w.deferred, nil
+		}
+		return nil
+	}
+	if w.closedFiles != nil {
+		summary := w.selectEvents(w.diffFiles(w.detector(), w.closedFiles, files))
+		events = append(w.missed, w.rewriteEvents(w.coalesce(summary, files))...)
+		w.closedFiles, w.missed = nil, nil
+	}
+	return events
+}
+
+// deferEvents adds events to any events deferred during previous cycles
+// and returns the ones that can be sent during this cycle, deferring the rest.
+func (w *Watcher) deferEvents(events []Event) []Event {
+	events = append(w.deferred, events...)
+	w.deferred = nil
+
+	if n := w.maxEventsPerCycle; n > 0 && len(events) > n {
+		w.deferred = append([]Event(nil), events[n:]...)
+		events = events[:n]
+	}
+	return events
+}
+
+// sendQueued sends the events queued during the current cycle on the
+// Event channel, or the event sink if there is one. It returns ErrClosed or
+// errExpired if the watcher was closed or ran out of time before all of them
+// were received.
+func (w *Watcher) sendQueued() error {
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			return nil
+		}
+		event := w.queue[0]
+		event.EmittedAt = w.clock.Now()
+		drained, expired := w.drained, w.expired
+		var out chan<- Event = w.Event
+		if w.sink != nil {
+			out = w.sink
+		}
+		stream := w.stream
+		w.mu.Unlock()
+
+		if stream != nil {
+			// The event counts as sent even if it couldn't be written.
+			if err := stream.write(event); err != nil && !w.sendError(err) {
+				return ErrClosed
+			}
+		} else {
+			sent, err := w.deliver(out, event, drained, expired)
+			if err != nil {
+				return err
+			}
+			if !sent {
+				// The queue was emptied by Drain, so stop sending the event.
+				continue
+			}
 		}
+
 		w.mu.Lock()
-		w.ignored[path] = struct{}{}
+		if len(w.queue) > 0 {
+			w.queue = w.queue[1:]
+		}
+		w.track(event)
+		w.remember(event)
+		w.lastActivity = w.clock.Now()
+		if w.stopAfterFirstEvent {
+			// Don't send anything else.
+			w.sentFirstEvent = true
+			w.queue = nil
+			w.mu.Unlock()
+			return nil
+		}
 		w.mu.Unlock()
 	}
-	return nil
 }
 
-// WatchedFiles returns a map of files added to a Watcher.
-func (w *Watcher) WatchedFiles() map[string]os.FileInfo {
+// deliver sends event on out. It returns false if the queue is emptied by
+// Drain first, ErrClosed if the watcher is closed first and errExpired if
+// expired receives first.
+func (w *Watcher) deliver(out chan<- Event, event Event, drained <-chan struct{}, expired <-chan time.Time) (bool, error) {
+	select {
+	case <-w.close:
+		return false, ErrClosed
+	case <-drained:
+		return false, nil
+	case <-expired:
+		return false, errExpired
+	case out <- event:
+		return true, nil
+	}
+}
+
+// SetEventSink makes the watcher send the events it finds on ch instead of
+// the Event channel, so that its capacity and lifetime can be controlled by
+// the caller. If ch is nil, events are sent on the Event channel again. The
+// watcher may send on ch until SetEventSink is called again or Start
+// returns, so ch must not be closed before then. Events sent by TriggerEvent
+// are still sent on the Event channel, and WaitFor only receives from the
+// Event channel.
+func (w *Watcher) SetEventSink(ch chan<- Event) {
+	w.mu.Lock()
+	w.sink = ch
+	w.mu.Unlock()
+}
+
+// An EventFormat describes how events are written by StreamTo.
+type EventFormat int
+
+const (
+	// FormatText writes each event on its own line in the form returned by
+	// Event.String.
+	FormatText EventFormat = iota
+
+	// FormatJSON writes each event on its own line as JSON, in the form
+	// returned by Event.MarshalJSON.
+	FormatJSON
+)
+
+// eventStream is where StreamTo writes events.
+type eventStream struct {
+	out    io.Writer
+	format EventFormat
+}
+
+// write writes event to the stream, with a single call to Write.
+func (s *eventStream) write(event Event) error {
+	var line []byte
+	if s.format == FormatJSON {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(event.String() + "\n")
+	}
+	_, err := s.out.Write(line)
+	return err
+}
+
+// StreamTo makes the watcher write the events it finds to out in format as
+// they occur, instead of sending them on the Event channel or the event
+// sink, so that events can be sent to a file, pipe or socket without a
+// goroutine receiving them. Errors writing to out are sent on the Error
+// channel, and the events that couldn't be written are dropped. If out is
+// nil, events are sent on channels again. Events sent by TriggerEvent are
+// still sent on the Event channel.
+func (w *Watcher) StreamTo(out io.Writer, format EventFormat) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	files := make(map[string]os.FileInfo)
-	for k, v := range w.files {
-		files[k] = v
+	if out == nil {
+		w.stream = nil
+		return
 	}
+	w.stream = &eventStream{out: out, format: format}
+}
 
-	return files
+// A TriggerMode describes when events are sent for files.
+type TriggerMode int
+
+const (
+	// Edge only sends events when files change, which is the default.
+	Edge TriggerMode = iota
+
+	// Level also sends a Write event every cycle for each file that a
+	// Create or Write event was sent for, until the file is acknowledged
+	// with Ack or removed.
+	Level
+)
+
+// unackedEvent is a sent event that hasn't been acknowledged yet.
+type unackedEvent struct {
+	event  Event // as it was sent.
+	source Event // before its paths were rewritten.
+	sent   time.Time
 }
 
-// fileInfo is an implementation of os.FileInfo that can be used
-// as a mocked os.FileInfo when triggering an event when the specified
-// os.FileInfo is nil.
-type fileInfo struct {
-	name    string
-	size    int64
-	mode    os.FileMode
-	modTime time.Time
-	sys     interface{}
-	dir     bool
+// SetTriggerMode sets when events are sent for files.
+func (w *Watcher) SetTriggerMode(mode TriggerMode) {
+	w.mu.Lock()
+	w.triggerMode = mode
+	if !w.tracking() {
+		w.unacked = make(map[string]unackedEvent)
+		w.sources = make(map[string]Event)
+	}
+	w.mu.Unlock()
 }
 
-func (fs *fileInfo) IsDir() bool {
-	return fs.dir
+// SetAckTimeout makes the watcher send Create and Write events again if
+// they haven't been acknowledged with Ack within d of being sent, which
+// gives at-least-once delivery to receivers that might stop before they
+// finish processing an event. If d is less than 1 nanosecond, events are
+// never sent again, which is the default. Timeouts are checked once every
+// polling cycle.
+func (w *Watcher) SetAckTimeout(d time.Duration) {
+	w.mu.Lock()
+	w.ackTimeout = d
+	if !w.tracking() {
+		w.unacked = make(map[string]unackedEvent)
+		w.sources = make(map[string]Event)
+	}
+	w.mu.Unlock()
 }
-func (fs *fileInfo) ModTime() time.Time {
-	return fs.modTime
+
+// tracking reports whether sent events need to be acknowledged.
+func (w *Watcher) tracking() bool {
+	return w.triggerMode == Level || w.ackTimeout > 0
 }
-func (fs *fileInfo) Mode() os.FileMode {
-	return fs.mode
+
+// Ack acknowledges that the latest event for e's path has been processed,
+// so that it's no longer sent again.
+func (w *Watcher) Ack(e Event) {
+	w.mu.Lock()
+	delete(w.unacked, e.Path)
+	w.mu.Unlock()
 }
-func (fs *fileInfo) Name() string {
-	return fs.name
+
+// track remembers a sent event until it's acknowledged, if needed.
+func (w *Watcher) track(event Event) {
+	if !w.tracking() {
+		return
+	}
+
+	source, found := w.sources[event.Path]
+	if !found {
+		source = event
+	}
+	delete(w.sources, event.Path)
+
+	switch event.Op {
+	case Create, Write:
+		// Keep the original event when it's sent again.
+		if u, found := w.unacked[event.Path]; found && w.ackTimeout > 0 {
+			event, source = u.event, u.source
+		}
+		w.unacked[event.Path] = unackedEvent{event: event, source: source, sent: w.clock.Now()}
+	case Remove, DirRemove:
+		delete(w.unacked, event.Path)
+	case Rename, Move:
+		delete(w.unacked, event.OldPath)
+	}
 }
-func (fs *fileInfo) Size() int64 {
-	return fs.size
+
+// SetCoalesceByDir sets whether the events found in each cycle are replaced
+// by a single Write event for each directory that had files change in it,
+// whose Children method returns the paths of those files, in the order of
+// their events. Events for the directories themselves, such as the Write events
+// of directories whose entries changed, are left out when their directories
+// have events of their own.
+func (w *Watcher) SetCoalesceByDir(coalesce bool) {
+	w.mu.Lock()
+	w.coalesceByDir = coalesce
+	w.mu.Unlock()
 }
-func (fs *fileInfo) Sys() interface{} {
-	return fs.sys
+
+// coalesce replaces events with an event for each of the directories
+// that the events are in, if needed.
+func (w *Watcher) coalesce(events []Event, files map[string]os.FileInfo) []Event {
+	if !w.coalesceByDir || len(events) == 0 {
+		return events
+	}
+
+	dirs := make(map[string]int) // index of each directory's event.
+	for _, event := range events {
+		dirs[filepath.Dir(event.Path)] = -1
+	}
+
+	var coalesced []Event
+	for _, event := range events {
+		if _, changed := dirs[event.Path]; changed && (event.Op == Write || event.Op == Chmod) {
+			continue
+		}
+		dir := filepath.Dir(event.Path)
+		i := dirs[dir]
+		if i < 0 {
+			i = len(coalesced)
+			dirs[dir] = i
+			coalesced = append(coalesced, Event{
+				Op:       Write,
+				Path:     dir,
+				OldPath:  dir,
+				FileInfo: w.dirInfo(dir, files),
+				Root:     event.Root,
+				children: new([]string),
+			})
+		}
+		if children := *coalesced[i].children; len(children) == 0 || children[len(children)-1] != event.Path {
+			*coalesced[i].children = append(children, event.Path)
+		}
+	}
+	return coalesced
 }
 
-// TriggerEvent is a method that can be used to trigger an event, separate to
-// the file watching process.
-func (w *Watcher) TriggerEvent(eventType Op, file os.FileInfo) {
-	w.Wait()
-	if file == nil {
-		file = &fileInfo{name: "triggered event", modTime: time.Now()}
+// dirInfo returns the os.FileInfo of the directory dir, from files if it's
+// there, from the files watched before if it was removed, or otherwise from
+// the directory itself.
+func (w *Watcher) dirInfo(dir string, files map[string]os.FileInfo) os.FileInfo {
+	if info, found := files[dir]; found {
+		return info
+	}
+	if info, found := w.files[dir]; found {
+		return info
 	}
-	w.Event <- Event{Op: eventType, Path: "-", FileInfo: file}
+	info, _ := os.Stat(extendedPath(dir))
+	return info
 }
 
-func (w *Watcher) retrieveFileList() map[string]os.FileInfo {
+// remind returns an event for each unacknowledged file in files that
+// doesn't already have one of events or a deferred event waiting to be sent,
+// and forgets about the files that aren't watched anymore. Events that timed
+// out are sent again as they were, and other files cause Write events when
+// the trigger mode is Level. Like events, they're from before their paths
+// were rewritten, so that they're filtered and rewritten in the same way.
+func (w *Watcher) remind(events []Event, files map[string]os.FileInfo) []Event {
+	if len(w.unacked) == 0 {
+		return nil
+	}
+
+	found := make(map[string]struct{})
+	for _, event := range events {
+		found[event.Path] = struct{}{}
+	}
+	deferred := make(map[string]struct{})
+	for _, event := range w.deferred {
+		deferred[event.Path] = struct{}{}
+	}
+
+	paths := make([]string, 0, len(w.unacked))
+	for path := range w.unacked {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var reminders []Event
+	now := w.clock.Now()
+	for _, path := range paths {
+		u := w.unacked[path]
+		info, watched := files[u.source.Path]
+		if !watched {
+			delete(w.unacked, path)
+			continue
+		}
+		if _, waiting := found[u.source.Path]; waiting {
+			continue
+		}
+		if _, waiting := deferred[path]; waiting {
+			continue
+		}
+		switch {
+		case w.ackTimeout > 0 && now.Sub(u.sent) >= w.ackTimeout:
+			reminders = append(reminders, u.source)
+		case w.triggerMode == Level:
+			reminders = append(reminders, Event{Op: Write, Path: u.source.Path, FileInfo: info})
+		}
+	}
+	return reminders
+}
+
+// SetMaxRunTime makes the watcher close itself once it has been running for
+// d, whether or not any events were sent, after which Start returns nil. It's
+// closed as soon as d has passed, even while waiting for an event to be
+// received, but a change to d while the watcher is running is only checked
+// once every polling cycle. If d is less than 1 nanosecond, the watcher runs
+// until it's closed, which is the default.
+func (w *Watcher) SetMaxRunTime(d time.Duration) {
+	w.mu.Lock()
+	w.maxRunTime = d
+	w.mu.Unlock()
+}
+
+// SetIdleTimeout makes the watcher close itself once no events have been
+// sent on the Event channel for d, after which Start returns nil. The
+// timeout is checked once every polling cycle. If d is less than 1
+// nanosecond, the watcher never closes itself, which is the default.
+func (w *Watcher) SetIdleTimeout(d time.Duration) {
+	w.mu.Lock()
+	w.idleTimeout = d
+	w.mu.Unlock()
+}
+
+// stop resets a watcher whose polling cycle is ending on its own, in the
+// same way that Close does, and closes the Closed channel.
+func (w *Watcher) stop() {
+	w.mu.Lock()
+	if !w.running {
+		// Close was called meanwhile and is waiting to send its signal.
+		w.mu.Unlock()
+		<-w.close
+		w.finish()
+		return
+	}
+	notify := w.release()
+	w.mu.Unlock()
+	notify()
+
+	w.finish()
+}
+
+// release stops the watcher and forgets what it was watching, ready for the
+// Remove events left to send by SetEmitRemoveOnClose to be sent by finish. It
+// returns the function that notifies of the state change, to be called once
+// w.mu is unlocked.
+func (w *Watcher) release() func() {
+	w.running = false
+	notify := w.setState(Closed)
+	if w.emitRemoveOnClose {
+		w.closing = w.closingEvents()
+	}
+	w.files = make(map[string]os.FileInfo)
+	w.names = make(map[string]bool)
+	w.depths = make(map[string]int)
+	w.shallow = make(map[string]struct{})
+	w.matching = make(map[string]matching)
+	w.excluded = make(map[string]struct{})
+	w.unacked = make(map[string]unackedEvent)
+	w.sources = make(map[string]Event)
+	w.schedules = make(map[string]*schedule)
+	w.queue = nil
+	w.deferred = nil
+	w.closedFiles = nil
+	w.missed = nil
+	return notify
+}
+
+// finish sends the Remove events left to send by SetEmitRemoveOnClose, if
+// any, and then closes the Closed channel.
+func (w *Watcher) finish() {
+	w.mu.Lock()
+	events := w.closing
+	w.closing = nil
+	var out chan<- Event = w.Event
+	if w.sink != nil {
+		out = w.sink
+	}
+	stream, clock := w.stream, w.clock
+	w.mu.Unlock()
+
+	for _, event := range events {
+		event.EmittedAt = clock.Now()
+		if stream != nil {
+			// There's no one left to report write errors to.
+			stream.write(event)
+			continue
+		}
+		w.deliver(out, event, nil, nil)
+	}
+	close(w.Closed)
+}
+
+// closingEvents returns a Remove event for each of the watched files,
+// ordered by SetRemoveOrder, and filtered and rewritten like the events
+// found while polling.
+func (w *Watcher) closingEvents() []Event {
+	var events []Event
+	for _, path := range orderedPaths(w.files, w.removeOrder) {
+		event := Event{Op: Remove, Path: path, OldPath: path, FileInfo: w.files[path]}
+		if event, ok := w.selectEvent(event, false); ok {
+			events = append(events, event)
+		}
+	}
+	return w.rewriteEvents(events)
+}
+
+// SetEmitRemoveOnClose sets whether a Remove event is sent for each of the
+// watched files when the watcher is closed, before the Closed channel is
+// closed, so that receivers keeping track of the files can let go of them.
+// They're sent in the order set by SetRemoveOrder, and they're filtered and
+// their paths are rewritten like any other events. The events are sent
+// whether or not they're received, so once the watcher is closed, they have
+// to be received for Start to return.
+func (w *Watcher) SetEmitRemoveOnClose(emit bool) {
+	w.mu.Lock()
+	w.emitRemoveOnClose = emit
+	w.mu.Unlock()
+}
+
+// Pending returns the number of events that have been found but
+// not yet received from the Event channel.
+func (w *Watcher) Pending() int {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	fileList := make(map[string]os.FileInfo)
+	return len(w.queue) + len(w.deferred)
+}
 
-	var list map[string]os.FileInfo
-	var err error
+// SetLastEventCache sets how many paths LastEvent remembers the last event
+// for, forgetting the paths whose last event was sent longest ago first. If
+// size is less than 1, which is the default, no events are remembered.
+// Calling it forgets any events remembered so far.
+func (w *Watcher) SetLastEventCache(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	for name, recursive := range w.names {
-		if recursive {
-			list, err = w.listRecursive(name)
-			if err != nil {
-				if os.IsNotExist(err) {
-					w.mu.Unlock()
-					if name == err.(*os.PathError).Path {
-						w.Error <- ErrWatchedFileDeleted
-						w.RemoveRecursive(name)
-					}
-					w.mu.Lock()
-				} else {
-					w.Error <- err
-				}
+	w.lastEvents = nil
+	if size > 0 {
+		w.lastEvents = newEventCache(size)
+	}
+}
+
+// LastEvent returns the most recent event that was sent for path, either
+// as its Path or its OldPath, if it's remembered. See SetLastEventCache.
+func (w *Watcher) LastEvent(path string) (Event, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Event{}, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.lastEvents == nil {
+		return Event{}, false
+	}
+	return w.lastEvents.get(path)
+}
+
+// remember makes a sent event the last event for its paths if needed.
+func (w *Watcher) remember(event Event) {
+	if w.lastEvents == nil {
+		return
+	}
+	w.lastEvents.add(event.Path, event)
+	if event.OldPath != "" && event.OldPath != event.Path {
+		w.lastEvents.add(event.OldPath, event)
+	}
+}
+
+// Drain discards the events that have been found but not yet received
+// from the Event channel, without blocking, and returns how many were
+// discarded. Events found after Drain returns are sent as usual.
+func (w *Watcher) Drain() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(w.queue) + len(w.deferred)
+	w.queue = nil
+	w.deferred = nil
+
+	// Stop sendQueued from sending the event it was about to send.
+	close(w.drained)
+	w.drained = make(chan struct{})
+
+	return n
+}
+
+// pollEvents compares files against the current file's list and returns
+// the events found. Events of each type are ordered by path.
+func (w *Watcher) pollEvents(files map[string]os.FileInfo) []Event {
+	d := w.detector()
+
+	// Keep track of which files can be read if needed.
+	if w.watchAccessibility {
+		readable := make(map[string]bool, len(files))
+		for path := range files {
+			readable[path] = isReadable(path)
+		}
+		d.oldReadable, d.newReadable = w.readable, readable
+	}
+	w.readable = d.newReadable
+
+	// Keep track of the extended attributes of files whose other
+	// metadata hasn't changed if needed.
+	if w.watchXattrs {
+		xattrs := make(map[string]string, len(files))
+		for path, info := range files {
+			if old, found := w.files[path]; found && !sameMetadata(old, info) {
+				continue
 			}
-		} else {
-			list, err = w.list(name)
-			if err != nil {
-				if os.IsNotExist(err) {
-					w.mu.Unlock()
-					if name == err.(*os.PathError).Path {
-						w.Error <- ErrWatchedFileDeleted
-						w.Remove(name)
-					}
-					w.mu.Lock()
-				} else {
-					w.Error <- err
-				}
+			if attrs, ok := readXattrs(path); ok {
+				xattrs[path] = attrs
 			}
 		}
-		// Add the file's to the file list.
-		for k, v := range list {
-			fileList[k] = v
-		}
+		d.oldXattrs, d.newXattrs = w.xattrs, xattrs
 	}
+	w.xattrs = d.newXattrs
 
-	return fileList
-}
+	// Count the entries of directories if needed.
+	if w.watchDirEmptiness {
+		d.oldEntries, d.newEntries = w.dirEntries, countEntries(files)
+	}
+	w.dirEntries = d.newEntries
 
-// Start begins the polling cycle which repeats every specified
-// duration until Close is called.
-func (w *Watcher) Start(d time.Duration) error {
-	// Return an error if d is less than 1 nanosecond.
-	if d < time.Nanosecond {
-		return ErrDurationTooShort
+	return w.diffFiles(d, w.files, files)
+}
+
+// detector returns a detector that finds changes the way the watcher is set
+// to.
+func (w *Watcher) detector() detector {
+	return detector{
+		followed:          w.followed,
+		trackOffsets:      w.trackOffsets,
+		strictChmod:       w.strictChmod,
+		moveSizeTolerance: w.moveSizeTolerance,
+		modTimeResolution: w.modTimeResolution,
+		trackInodes:       w.trackInodes,
+		useCtime:          w.useCtime,
+		watchNlink:        w.watchNlink,
+		removeOrder:       w.removeOrder,
 	}
+}
 
-	// Make sure the Watcher is not already running.
-	w.mu.Lock()
-	if w.running {
-		w.mu.Unlock()
-		return ErrWatcherRunning
+// diffFiles returns the events that d finds between oldFiles and newFiles,
+// leaving out the ones in gated directories.
+func (w *Watcher) diffFiles(d detector, oldFiles, newFiles map[string]os.FileInfo) []Event {
+	events := w.ungated(d.diff(oldFiles, newFiles), newFiles)
+	forgetSniffed(events)
+	for i := range events {
+		if w.trackInodes {
+			events[i].Inode, _ = inode(events[i].FileInfo)
+		}
+		events[i].Nlink, _ = nlink(events[i].FileInfo)
 	}
-	w.running = true
-	w.mu.Unlock()
+	return events
+}
 
-	// Unblock w.Wait().
-	w.wg.Done()
+// detector finds the events that describe the changes between two lists
+// of files. Its zero value compares files in the same way as Snapshot.Diff.
+type detector struct {
+	// Paths whose files are replaced when they're rotated.
+	followed map[string]struct{}
 
-	for {
-		// done lets the inner polling cycle loop know when the
-		// current cycle's method has finished executing.
-		done := make(chan struct{})
+	// Whether to set the offsets of write events.
+	trackOffsets bool
 
-		// Any events that are found are first piped to evt before
-		// being sent to the main Event channel.
-		evt := make(chan Event)
+	// Whether only permission changes count as mode changes.
+	strictChmod bool
 
-		// Retrieve the file list for all watched file's and dirs.
-		fileList := w.retrieveFileList()
+	// How much the sizes of similar files can differ by for them to be
+	// paired as moves when they aren't the same file.
+	moveSizeTolerance int64
 
-		// cancel can be used to cancel the current event polling function.
-		cancel := make(chan struct{})
+	// What modification times are truncated to before being compared.
+	modTimeResolution time.Duration
 
-		// Look for events.
-		go func() {
-			w.pollEvents(fileList, evt, cancel)
-			done <- struct{}{}
-		}()
+	// Whether files whose inodes change are treated as new files.
+	trackInodes bool
 
-		// numEvents holds the number of events for the current cycle.
-		numEvents := 0
+	// Whether files whose ctimes change are treated as written to.
+	useCtime bool
 
-	inner:
-		for {
-			select {
-			case <-w.close:
-				close(cancel)
-				close(w.Closed)
-				return nil
-			case event := <-evt:
-				if len(w.ops) > 0 { // Filter Ops.
-					_, found := w.ops[event.Op]
-					if !found {
-						continue
-					}
-				}
-				numEvents++
-				if w.maxEvents > 0 && numEvents > w.maxEvents {
-					close(cancel)
-					break inner
-				}
-				w.Event <- event
-			case <-done: // Current cycle is finished.
-				break inner
-			}
-		}
+	// Whether to send attrib events when the number of hard links to
+	// files changes.
+	watchNlink bool
 
-		// Update the file's list.
-		w.mu.Lock()
-		w.files = fileList
-		w.mu.Unlock()
+	// The order that Remove events of nested files are sent in.
+	removeOrder RemoveOrder
 
-		// Sleep and then continue to the next loop iteration.
-		time.Sleep(d)
-	}
+	// Whether files could be read in the old and new lists, used
+	// to send chmods when files become readable or unreadable.
+	oldReadable, newReadable map[string]bool
+
+	// The extended attributes of files in the old and new lists, used
+	// to send attrib events when they change.
+	oldXattrs, newXattrs map[string]string
+
+	// The number of entries that directories have in the old and new
+	// lists, used to send events when they become empty or non-empty.
+	oldEntries, newEntries map[string]int
 }
 
-func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
-	cancel chan struct{}) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// diff returns the events that describe the changes from oldFiles to
+// newFiles. Events of each type are ordered by path.
+func (d *detector) diff(oldFiles, newFiles map[string]os.FileInfo) []Event {
+	var events []Event
 
 	// Store create and remove events for use to check for rename events.
 	creates := make(map[string]os.FileInfo)
 	removes := make(map[string]os.FileInfo)
 
 	// Check for removed files.
-	for path, info := range w.files {
-		if _, found := files[path]; !found {
+	for path, info := range oldFiles {
+		if _, found := newFiles[path]; !found {
 			removes[path] = info
 		}
 	}
 
 	// Check for created files, writes and chmods.
-	for path, info := range files {
-		oldInfo, found := w.files[path]
+	for _, path := range sortedPaths(newFiles) {
+		info := newFiles[path]
+		oldInfo, found := oldFiles[path]
 		if !found {
 			// A file was created.
 			creates[path] = info
 			continue
 		}
-		if oldInfo.ModTime() != info.ModTime() {
-			select {
-			case <-cancel:
-				return
-			case evt <- Event{Write, path, path, info}:
+		if _, followed := d.followed[path]; followed && rotationDetectable && !sameFile(oldInfo, info) {
+			// The file was replaced by a new one.
+			events = append(events, Event{Op: Rotated, Path: path, OldPath: path, FileInfo: info})
+			continue
+		}
+		if d.trackInodes && inodeChanged(oldInfo, info) {
+			// A different file was created in place of the old one.
+			creates[path] = info
+			continue
+		}
+		changed := Changes{
+			ModTime: oldInfo.ModTime() != info.ModTime(),
+			Size:    oldInfo.Size() != info.Size(),
+			Mode:    oldInfo.Mode() != info.Mode(),
+		}
+		if d.strictChmod {
+			changed.Mode = oldInfo.Mode().Perm() != info.Mode().Perm()
+		}
+		if r := d.modTimeResolution; r > 0 {
+			changed.ModTime = !oldInfo.ModTime().Truncate(r).Equal(info.ModTime().Truncate(r))
+		}
+		if d.useCtime {
+			changed.Ctime = ctimeChanged(oldInfo, info)
+		}
+		if changed.ModTime || changed.Ctime && !changed.Mode {
+			e := Event{Op: Write, Path: path, OldPath: path, FileInfo: info, Changed: changed}
+			if d.trackOffsets {
+				if info.Size() < oldInfo.Size() {
+					e.Truncated = true
+				} else {
+					e.Offset = oldInfo.Size()
+				}
 			}
+			events = append(events, e)
+		}
+		if changed.Mode || d.readabilityChanged(path) {
+			events = append(events, Event{Op: Chmod, Path: path, OldPath: path, FileInfo: info, Changed: changed})
+		}
+		if d.xattrsChanged(path) || d.watchNlink && !info.IsDir() && nlinkChanged(oldInfo, info) {
+			events = append(events, Event{Op: Attrib, Path: path, OldPath: path, FileInfo: info})
+		}
+		if was, is, known := d.entriesChanged(path); known && was > 0 && is == 0 {
+			events = append(events, Event{Op: DirEmpty, Path: path, OldPath: path, FileInfo: info})
+		} else if known && was == 0 && is > 0 {
+			events = append(events, Event{Op: DirNonEmpty, Path: path, OldPath: path, FileInfo: info})
 		}
-		if oldInfo.Mode() != info.Mode() {
-			select {
-			case <-cancel:
-				return
-			case evt <- Event{Chmod, path, path, info}:
+	}
+
+	// Check for renames and moves, first between files that are the same
+	// and then between files that are similar enough.
+	moves := pairMoves(removes, creates, sameFile)
+	if d.moveSizeTolerance > 0 {
+		moves = append(moves, pairMoves(removes, creates, d.similarFile)...)
+	}
+	events = append(events, collapseDirMoves(moves, removes, creates)...)
+
+	// Add all the remaining create and remove events.
+	for _, path := range sortedPaths(creates) {
+		events = append(events, Event{Op: Create, Path: path, FileInfo: creates[path]})
+	}
+	for _, path := range orderedPaths(removes, d.removeOrder) {
+		events = append(events, Event{Op: Remove, Path: path, OldPath: path, FileInfo: removes[path]})
+	}
+
+	return events
+}
+
+// collapseDirMoves drops the events for files that were renamed or moved
+// along with a directory that they're below, so that there's a single event
+// for the directory. Files that were removed from or created in a directory
+// while it was moved still cause events.
+func collapseDirMoves(moves []Event, removes, creates map[string]os.FileInfo) []Event {
+	var dirs []Event
+	for _, e := range moves {
+		if e.IsDir() {
+			dirs = append(dirs, e)
+		}
+	}
+	if len(dirs) == 0 {
+		return moves
+	}
+
+	// movedPath returns the path that oldPath was moved to along with one
+	// of the directories, if it's below one of them.
+	movedPath := func(oldPath string) (string, bool) {
+		for _, dir := range dirs {
+			if isUnder(oldPath, dir.OldPath) {
+				return dir.Path + oldPath[len(dir.OldPath):], true
 			}
 		}
+		return "", false
+	}
+
+	var collapsed []Event
+	for _, e := range moves {
+		if path, found := movedPath(e.OldPath); !found || path != e.Path {
+			collapsed = append(collapsed, e)
+		}
 	}
 
-	// Check for renames and moves.
-	for path1, info1 := range removes {
-		for path2, info2 := range creates {
-			if sameFile(info1, info2) {
+	// Files that weren't paired up but are in the same place below
+	// a directory were moved along with it too.
+	for oldPath := range removes {
+		path, found := movedPath(oldPath)
+		if _, created := creates[path]; found && created {
+			delete(removes, oldPath)
+			delete(creates, path)
+		}
+	}
+
+	return collapsed
+}
+
+// similarFile reports whether two files that aren't directories have the
+// same mode and sizes that differ by no more than the move size tolerance.
+func (d *detector) similarFile(fi1, fi2 os.FileInfo) bool {
+	if fi1.IsDir() || fi2.IsDir() || fi1.Mode() != fi2.Mode() {
+		return false
+	}
+	delta := fi1.Size() - fi2.Size()
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta <= d.moveSizeTolerance
+}
+
+// pairMoves returns Rename and Move events for the removed and created files
+// that match reports are the same file, deleting them from removes and creates.
+func pairMoves(removes, creates map[string]os.FileInfo, match func(fi1, fi2 os.FileInfo) bool) []Event {
+	var events []Event
+	created := sortedPaths(creates)
+	for _, path1 := range sortedPaths(removes) {
+		info1 := removes[path1]
+		for _, path2 := range created {
+			// Skip the files that were already paired.
+			info2, found := creates[path2]
+			if !found {
+				continue
+			}
+			if match(info1, info2) {
 				e := Event{
 					Op:       Move,
 					Path:     path2,
@@ -719,30 +4811,338 @@ func (w *Watcher) pollEvents(files map[string]os.FileInfo, evt chan Event,
 				delete(removes, path1)
 				delete(creates, path2)
 
-				select {
-				case <-cancel:
-					return
-				case evt <- e:
-				}
+				events = append(events, e)
+				break
 			}
 		}
 	}
+	return events
+}
 
-	// Send all the remaining create and remove events.
-	for path, info := range creates {
-		select {
-		case <-cancel:
-			return
-		case evt <- Event{Create, path, "", info}:
+// SetFollowRotation makes the watcher send a Rotated event instead of Write
+// or Chmod events when the watched file at path is replaced by a different
+// file, such as when a log file is rotated by renaming it and creating a new
+// one in its place. The path must also be watched using Add or AddRecursive.
+// Windows doesn't keep which file a listed file is, so rotations can't be
+// told apart from writes there, and no Rotated events are sent.
+func (w *Watcher) SetFollowRotation(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.followed[path] = struct{}{}
+	w.mu.Unlock()
+
+	return nil
+}
+
+// SetMoveSizeTolerance makes a removed file and a created file that aren't the
+// same file, such as when a file is edited while it's moved, be paired up as a
+// Rename or Move event if they have the same mode and their sizes differ by no
+// more than bytes. Files that are the same are always paired up first. Since
+// unrelated files can be similar enough too, this can cause false Rename and
+// Move events, more so with bigger tolerances. If bytes is less than 1, which
+// is the default, only files that are the same are paired up.
+func (w *Watcher) SetMoveSizeTolerance(bytes int64) {
+	w.mu.Lock()
+	w.moveSizeTolerance = bytes
+	w.mu.Unlock()
+}
+
+// SetModTimeResolution makes modification times be truncated to multiples
+// of d before they're compared, so that changes smaller than d, such as
+// jitter from some editors, don't cause Write events. If d is less than 1
+// nanosecond, which is the default, modification times are compared as
+// they are.
+func (w *Watcher) SetModTimeResolution(d time.Duration) {
+	w.mu.Lock()
+	w.modTimeResolution = d
+	w.mu.Unlock()
+}
+
+// SetStrictChmod sets whether Chmod events are only sent when a file's
+// permission bits change. By default, a change to any of its mode bits,
+// such as its type or setuid bits, causes a Chmod event.
+func (w *Watcher) SetStrictChmod(strict bool) {
+	w.mu.Lock()
+	w.strictChmod = strict
+	w.mu.Unlock()
+}
+
+// SetWatchXattrs sets whether an Attrib event is sent when the extended
+// attributes of a file change. To limit how often they're read, a file's
+// extended attributes are only compared when its modification time, size
+// and mode haven't changed, since other events are sent for it otherwise.
+// Extended attributes are only supported on Linux and macOS, and no Attrib
+// events are sent for them on other platforms.
+func (w *Watcher) SetWatchXattrs(watch bool) {
+	w.mu.Lock()
+	w.watchXattrs = watch
+	w.mu.Unlock()
+}
+
+// SetWatchNlink sets whether an Attrib event is sent when the number of hard
+// links to a file changes, such as when a link to it is made or removed.
+// Directories are left out, since their link counts change whenever
+// directories are created or removed in them, which already causes Write
+// events. Hard link counts are only known on Unix systems, and aren't kept by
+// SetCompactState, so no Attrib events are sent for them otherwise.
+func (w *Watcher) SetWatchNlink(watch bool) {
+	w.mu.Lock()
+	w.watchNlink = watch
+	w.mu.Unlock()
+}
+
+// SetWatchDirEmptiness sets whether a DirNonEmpty event is sent when a
+// directory that had no entries gets some, and a DirEmpty event when one that
+// had entries has none left. Only the entries being watched are counted, so
+// ignored and filtered files aren't, and neither are the entries of
+// directories whose contents aren't watched.
+func (w *Watcher) SetWatchDirEmptiness(watch bool) {
+	w.mu.Lock()
+	w.watchDirEmptiness = watch
+	w.mu.Unlock()
+}
+
+// SetTrackInodes sets whether events have their Inode field set, and
+// whether a Create event is sent instead of a Write event when the file at a
+// path is replaced by a different file, even if it looks like the old one was
+// written to. On systems without inodes, such as Windows, Inode is left unset
+// and files are compared as usual.
+func (w *Watcher) SetTrackInodes(track bool) {
+	w.mu.Lock()
+	w.trackInodes = track
+	w.mu.Unlock()
+}
+
+// SetUseCtime sets whether a Write event is sent for a file when its status
+// change time, or ctime, changes, even if its modification time doesn't. On
+// overlay filesystems, which containers commonly use, copying a file up to
+// an upper layer can change its contents without changing its modification
+// time. The ctime also changes when a file's owner, links or extended
+// attributes change, so those cause Write events too, but mode changes only
+// cause Chmod events. Ctimes are only known on Linux, and aren't kept by
+// SetCompactState.
+func (w *Watcher) SetUseCtime(use bool) {
+	w.mu.Lock()
+	w.useCtime = use
+	w.mu.Unlock()
+}
+
+// ctimeChanged reports whether the status change time of the file that
+// oldInfo and info describe changed.
+func ctimeChanged(oldInfo, info os.FileInfo) bool {
+	was, wasKnown := ctime(oldInfo)
+	is, isKnown := ctime(info)
+	return wasKnown && isKnown && !was.Equal(is)
+}
+
+// nlinkChanged reports whether the number of hard links to the file that
+// oldInfo and info describe changed.
+func nlinkChanged(oldInfo, info os.FileInfo) bool {
+	was, wasKnown := nlink(oldInfo)
+	is, isKnown := nlink(info)
+	return wasKnown && isKnown && was != is
+}
+
+// inodeChanged reports whether the files that oldInfo and info describe
+// have different inodes.
+func inodeChanged(oldInfo, info os.FileInfo) bool {
+	was, wasKnown := inode(oldInfo)
+	is, isKnown := inode(info)
+	return wasKnown && isKnown && was != is
+}
+
+// SetTrackOffsets sets whether Write events have their Offset and Truncated
+// fields set, so that data appended to a file can be read from where the
+// file previously ended.
+func (w *Watcher) SetTrackOffsets(track bool) {
+	w.mu.Lock()
+	w.trackOffsets = track
+	w.mu.Unlock()
+}
+
+// readabilityChanged reports whether the file at path became readable
+// or unreadable.
+func (d *detector) readabilityChanged(path string) bool {
+	was, known := d.oldReadable[path]
+	is, found := d.newReadable[path]
+	return known && found && was != is
+}
+
+// countEntries returns the number of entries that each of the directories
+// in files has in files.
+func countEntries(files map[string]os.FileInfo) map[string]int {
+	entries := make(map[string]int)
+	for path, info := range files {
+		if info.IsDir() {
+			entries[path] += 0
+		}
+		dir := filepath.Dir(path)
+		if parent, found := files[dir]; found && parent.IsDir() && dir != path {
+			entries[dir]++
 		}
 	}
-	for path, info := range removes {
-		select {
-		case <-cancel:
-			return
-		case evt <- Event{Remove, path, path, info}:
+	return entries
+}
+
+// entriesChanged returns the number of entries that the directory at path
+// had and has, and whether both are known.
+func (d *detector) entriesChanged(path string) (was, is int, known bool) {
+	was, wasKnown := d.oldEntries[path]
+	is, isKnown := d.newEntries[path]
+	return was, is, wasKnown && isKnown
+}
+
+// xattrsChanged reports whether the extended attributes of the file at
+// path changed.
+func (d *detector) xattrsChanged(path string) bool {
+	was, known := d.oldXattrs[path]
+	is, found := d.newXattrs[path]
+	return known && found && was != is
+}
+
+// sameMetadata reports whether two files have the same modification
+// time, size and mode.
+func sameMetadata(fi1, fi2 os.FileInfo) bool {
+	return fi1.ModTime() == fi2.ModTime() &&
+		fi1.Size() == fi2.Size() &&
+		fi1.Mode() == fi2.Mode()
+}
+
+// Snapshot is a list of files and their os.FileInfo, keyed by path, such
+// as the ones returned by WatchedFiles and Watcher.Snapshot.
+type Snapshot map[string]os.FileInfo
+
+// Diff returns the events that describe the changes from s to other, found
+// in the same way as a watcher finds them between two polling cycles.
+func (s Snapshot) Diff(other Snapshot) ([]Event, error) {
+	for _, snapshot := range []Snapshot{s, other} {
+		for path, info := range snapshot {
+			if info == nil {
+				return nil, fmt.Errorf("error: snapshot has no file info for %s", path)
+			}
+		}
+	}
+
+	var d detector
+	return d.diff(s, other), nil
+}
+
+// Snapshot lists the files being watched, as they currently are, without
+// changing the files that the watcher compares the next cycle against.
+func (w *Watcher) Snapshot() (Snapshot, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	snapshot := make(Snapshot)
+	for name, recursive := range w.names {
+		if w.covered(name) {
+			continue
+		}
+
+		var list map[string]os.FileInfo
+		var err error
+		if recursive {
+			// Directories that wouldn't be descended into are left out,
+			// but aren't remembered.
+			list, err = w.listRecursive(name, make(map[string]struct{}), nil)
+		} else {
+			list, err = w.list(name)
+		}
+		if _, skipped := err.(*MultiError); err != nil && !skipped {
+			return nil, err
+		}
+
+		for k, v := range list {
+			snapshot[k] = v
+		}
+	}
+
+	return snapshot, nil
+}
+
+// SetWatchAccessibility sets whether a Chmod event is sent when a file
+// becomes readable or unreadable by the current process, such as when its
+// owner changes, even if its mode stays the same. Checking this requires
+// opening every watched file each cycle.
+func (w *Watcher) SetWatchAccessibility(watch bool) {
+	w.mu.Lock()
+	w.watchAccessibility = watch
+	w.mu.Unlock()
+}
+
+// isReadable reports whether the file at path can be opened for reading.
+func isReadable(path string) bool {
+	f, err := os.Open(extendedPath(path))
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// A RemoveOrder describes the order that the Remove events of files and the
+// directories that they're in are sent in, when they're removed at once.
+type RemoveOrder int
+
+const (
+	// ChildrenFirst sends the Remove events of the files in a directory
+	// before the directory's, which is the default.
+	ChildrenFirst RemoveOrder = iota
+
+	// ParentsFirst sends the Remove event of a directory before the ones
+	// of the files in it.
+	ParentsFirst
+)
+
+// SetRemoveOrder sets the order that the Remove events found in a cycle are
+// sent in. Either way, the events of files in the same directory are sent
+// in the order of their names.
+func (w *Watcher) SetRemoveOrder(order RemoveOrder) {
+	w.mu.Lock()
+	w.removeOrder = order
+	w.mu.Unlock()
+}
+
+// orderedPaths returns the paths of files, with the paths in each directory
+// ordered by name, and the directory's own path either after them for
+// ChildrenFirst or before them for ParentsFirst.
+func orderedPaths(files map[string]os.FileInfo, order RemoveOrder) []string {
+	paths := make([][]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, strings.Split(path, string(filepath.Separator)))
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := paths[i], paths[j]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		if order == ChildrenFirst {
+			return len(a) > len(b)
 		}
+		return len(a) < len(b)
+	})
+
+	ordered := make([]string, len(paths))
+	for i, path := range paths {
+		ordered[i] = strings.Join(path, string(filepath.Separator))
+	}
+	return ordered
+}
+
+// sortedPaths returns the paths in files in sorted order.
+func sortedPaths(files map[string]os.FileInfo) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
 	}
+	sort.Strings(paths)
+	return paths
 }
 
 // Wait blocks until the watcher is started.
@@ -757,10 +5157,146 @@ func (w *Watcher) Close() {
 		w.mu.Unlock()
 		return
 	}
-	w.running = false
-	w.files = make(map[string]os.FileInfo)
-	w.names = make(map[string]bool)
+	notify := w.release()
 	w.mu.Unlock()
+	notify()
 	// Send a close signal to the Start method.
 	w.close <- struct{}{}
 }
+
+// Reset makes a closed watcher usable again, as if it was just created with
+// New, but with everything that was set on it still set, such as its filter
+// hooks and ignored files. It waits for Start to return first. The Event and
+// Error channels are kept, but the Closed channel has been closed, so it's
+// replaced, and it has to be retrieved again with Done afterwards.
+// Nothing is watched after a reset, so the files and directories to watch
+// have to be added again. It returns ErrWatcherRunning if the watcher is
+// running, and does nothing if it was never started.
+func (w *Watcher) Reset() error {
+	w.mu.Lock()
+	state, closed := w.state, w.Closed
+	w.mu.Unlock()
+
+	switch state {
+	case Idle:
+		return nil
+	case Running, Paused:
+		return ErrWatcherRunning
+	}
+
+	// Wait for Start to return.
+	<-closed
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	w.mu.Lock()
+	w.Closed = make(chan struct{})
+	w.close = make(chan struct{}, 1)
+	w.wg = &wg
+	w.intervalChanged = make(chan struct{}, 1)
+	w.started = make(chan struct{})
+	w.synced = make(chan struct{})
+	w.pruned = make(map[string]struct{})
+	w.unstable = make(map[string]*unstableFile)
+	w.readable = nil
+	w.xattrs = nil
+	w.dirEntries = nil
+	w.lagCycles = 0
+	notify := w.setState(Idle)
+	w.mu.Unlock()
+	notify()
+
+	return nil
+}
+
+// A WatcherState describes where a watcher is in its lifecycle.
+type WatcherState int
+
+const (
+	// Idle is the state of a watcher that hasn't been started yet.
+	Idle WatcherState = iota
+
+	// Running is the state of a watcher that's checking for changes.
+	Running
+
+	// Paused is the state of a started watcher that's stopped checking
+	// for changes until it's resumed.
+	Paused
+
+	// Closed is the state of a watcher that has been closed, or that
+	// closed itself.
+	Closed
+)
+
+var states = map[WatcherState]string{
+	Idle:    "IDLE",
+	Running: "RUNNING",
+	Paused:  "PAUSED",
+	Closed:  "CLOSED",
+}
+
+// String prints the string version of the WatcherState consts
+func (s WatcherState) String() string {
+	if state, found := states[s]; found {
+		return state
+	}
+	return "???"
+}
+
+// State returns the current state of the watcher.
+func (w *Watcher) State() WatcherState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.state
+}
+
+// OnStateChange sets a function that's called with the old and new states
+// whenever the watcher's state changes: when it's started, paused, resumed
+// and closed. It's called from the goroutine that caused the change, after
+// the change was made, so it mustn't block for long.
+func (w *Watcher) OnStateChange(f func(old, new WatcherState)) {
+	w.mu.Lock()
+	w.stateHook = f
+	w.mu.Unlock()
+}
+
+// setState moves the watcher to state. It returns a function that calls the
+// state change hook if the state changed, which has to be called after
+// unlocking w.mu.
+func (w *Watcher) setState(state WatcherState) func() {
+	old, hook := w.state, w.stateHook
+	w.state = state
+	if hook == nil || old == state {
+		return func() {}
+	}
+	return func() { hook(old, state) }
+}
+
+// Pause stops a running watcher from checking for changes until Resume is
+// called. Changes made while it's paused are found by the first check after
+// it's resumed.
+func (w *Watcher) Pause() {
+	w.mu.Lock()
+	if w.state != Running {
+		w.mu.Unlock()
+		return
+	}
+	notify := w.setState(Paused)
+	w.mu.Unlock()
+	notify()
+}
+
+// Resume makes a paused watcher check for changes again from its next
+// polling cycle on.
+func (w *Watcher) Resume() {
+	w.mu.Lock()
+	if w.state != Paused {
+		w.mu.Unlock()
+		return
+	}
+	notify := w.setState(Running)
+	w.mu.Unlock()
+	notify()
+}
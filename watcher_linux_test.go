@@ -0,0 +1,216 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetWatchXattrs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	path := filepath.Join(testDir, "file.txt")
+	if err := syscall.Setxattr(path, "user.watcher", []byte("a"), 0); err != nil {
+		t.Skip("extended attributes aren't supported here:", err)
+	}
+
+	w := New()
+	w.SetWatchXattrs(true)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	w.pollEvents(w.retrieveFileList())
+
+	if err := syscall.Setxattr(path, "user.watcher", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.pollEvents(w.retrieveFileList())
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Attrib || events[0].Path != path {
+		t.Errorf("expected an Attrib event for %s, got %s for %s",
+			events[0].Op, events[0].Path, path)
+	}
+}
+
+func TestSetTrackInodes(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	path := filepath.Join(testDir, "file.txt")
+	oldInfo, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file with a different one that has the same
+	// modification time.
+	other := filepath.Join(testDir, "other.txt")
+	if err := ioutil.WriteFile(other, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(other, oldInfo.ModTime(), oldInfo.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(other, path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.files = map[string]os.FileInfo{path: oldInfo}
+	for _, event := range w.pollEvents(map[string]os.FileInfo{path: info}) {
+		if event.Op == Create {
+			t.Error("expected no Create events without tracking inodes")
+		}
+	}
+
+	w.SetTrackInodes(true)
+	events := w.pollEvents(map[string]os.FileInfo{path: info})
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Create {
+		t.Errorf("expected event to be Create, got %s", events[0].Op)
+	}
+	if ino := info.Sys().(*syscall.Stat_t).Ino; events[0].Inode != ino {
+		t.Errorf("expected inode %d, got %d", ino, events[0].Inode)
+	}
+}
+
+func TestNlinkChanged(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	path := filepath.Join(testDir, "file.txt")
+	oldInfo, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, filepath.Join(testDir, "link.txt")); err != nil {
+		t.Skip("hard links aren't supported here:", err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.files = map[string]os.FileInfo{path: oldInfo}
+	if events := w.pollEvents(map[string]os.FileInfo{path: info}); len(events) != 0 {
+		t.Errorf("expected no events without SetWatchNlink, got %v", events)
+	}
+
+	w.SetWatchNlink(true)
+	events := w.pollEvents(map[string]os.FileInfo{path: info})
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Attrib {
+		t.Errorf("expected event to be Attrib, got %s", events[0].Op)
+	}
+	if events[0].Nlink != 2 {
+		t.Errorf("expected 2 hard links, got %d", events[0].Nlink)
+	}
+}
+
+func TestSetUseCtime(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	path := filepath.Join(testDir, "file.txt")
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the owner changes the ctime but not the modification time.
+	time.Sleep(10 * time.Millisecond)
+	if err := os.Chown(path, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Skip("the modification time changed")
+	}
+
+	old := map[string]os.FileInfo{path: before}
+	changed := map[string]os.FileInfo{path: after}
+
+	d := &detector{}
+	if events := d.diff(old, changed); len(events) != 0 {
+		t.Errorf("expected no events without ctimes, got %v", events)
+	}
+
+	d.useCtime = true
+	events := d.diff(old, changed)
+	if len(events) != 1 || events[0].Op != Write || !events[0].Changed.Ctime {
+		t.Errorf("expected a write event for the ctime change, got %v", events)
+	}
+}
+
+func TestSetSameFilesystemOnly(t *testing.T) {
+	// /dev/pts is usually a separate filesystem mounted below /dev.
+	dev, err := os.Stat("/dev")
+	if err != nil {
+		t.Skip(err)
+	}
+	pts, err := os.Stat("/dev/pts")
+	if err != nil {
+		t.Skip(err)
+	}
+	if _, err := os.Stat("/dev/pts/ptmx"); err != nil {
+		t.Skip(err)
+	}
+	if dev.Sys().(*syscall.Stat_t).Dev == pts.Sys().(*syscall.Stat_t).Dev {
+		t.Skip("/dev/pts isn't a separate filesystem")
+	}
+
+	w := New()
+	w.SetSkipPermissionErrors(true)
+	w.SetSameFilesystemOnly(true)
+
+	list, err := w.listRecursive("/dev", nil, nil)
+	if _, ok := err.(*MultiError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	if _, found := list["/dev/pts"]; !found {
+		t.Error("expected /dev/pts to be watched")
+	}
+	if _, found := list["/dev/pts/ptmx"]; found {
+		t.Error("expected /dev/pts/ptmx not to be watched")
+	}
+}
+
+func TestSetWatchNlinkDirs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetWatchNlink(true)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Making a directory changes its parent's link count.
+	if err := os.Mkdir(filepath.Join(testDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range w.pollEvents(w.retrieveFileList()) {
+		if event.Op == Attrib {
+			t.Errorf("expected no attrib events for directories, got %v", event)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package watcher
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -509,6 +517,7 @@ func TestListFiles(t *testing.T) {
 
 func TestTriggerEvent(t *testing.T) {
 	w := New()
+	w.SetAllowEmpty(true)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -825,6 +834,7 @@ func TestWatcherStartWithInvalidDuration(t *testing.T) {
 
 func TestWatcherStartWhenAlreadyRunning(t *testing.T) {
 	w := New()
+	w.SetAllowEmpty(true)
 
 	go func() {
 		err := w.Start(time.Millisecond * 100)
@@ -902,6 +912,51 @@ func BenchmarkListFiles(b *testing.B) {
 	}
 }
 
+func BenchmarkCompactState(b *testing.B) {
+	testDir, teardown := setup(b)
+	defer teardown()
+
+	for i := 0; i < 100; i++ {
+		dir := filepath.Join(testDir, "dir_"+strconv.Itoa(i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(j)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	// How much memory is kept for each watched file is reported.
+	for _, compact := range []bool{false, true} {
+		b.Run("compact="+strconv.FormatBool(compact), func(b *testing.B) {
+			b.ReportAllocs()
+			var kept uint64
+			var files int
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				w := New()
+				w.SetCompactState(compact)
+				if err := w.AddRecursive(testDir); err != nil {
+					b.Fatal(err)
+				}
+				w.files = w.retrieveFileList()
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				kept += after.HeapAlloc - before.HeapAlloc
+				files += len(w.files)
+				runtime.KeepAlive(w)
+			}
+			b.ReportMetric(float64(kept)/float64(files), "B/file")
+		})
+	}
+}
+
 func TestClose(t *testing.T) {
 	testDir, teardown := setup(t)
 	defer teardown()
@@ -1001,7 +1056,14 @@ func TestOpsString(t *testing.T) {
 		{Rename, "RENAME"},
 		{Chmod, "CHMOD"},
 		{Move, "MOVE"},
-		{Op(10), "???"},
+		{DirCreate, "DIR_CREATE"},
+		{DirRemove, "DIR_REMOVE"},
+		{Rotated, "ROTATED"},
+		{Attrib, "ATTRIB"},
+		{DirEmpty, "DIR_EMPTY"},
+		{DirNonEmpty, "DIR_NON_EMPTY"},
+		{Stale, "STALE"},
+		{Op(13), "???"},
 	}
 
 	for _, tc := range testCases {
@@ -1010,3 +1072,4077 @@ func TestOpsString(t *testing.T) {
 		}
 	}
 }
+
+func TestPending(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Pending() != 0 {
+		t.Fatalf("expected pending to be 0, got %d", w.Pending())
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 100); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+	w.Wait()
+
+	for _, f := range []string{"newfile_1.txt", "newfile_2.txt", "newfile_3.txt"} {
+		filePath := filepath.Join(testDir, f)
+		if err := ioutil.WriteFile(filePath, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitPending := func(n int) {
+		timeout := time.After(time.Second)
+		for w.Pending() != n {
+			select {
+			case <-timeout:
+				t.Fatalf("expected pending to be %d, got %d", n, w.Pending())
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+
+	waitPending(3)
+	<-w.Event
+	waitPending(2)
+}
+
+func TestIgnoredPathsAndPatterns(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.IgnoreGlob("["); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	if err := w.IgnoreGlob("*_2.txt", "testDirTwo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Ignore(filepath.Join(testDir, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// testDir, .dotfile, file_1.txt and file_3.txt.
+	if len(w.files) != 4 {
+		t.Errorf("expected len(w.files) to be 4, got %d", len(w.files))
+	}
+
+	paths := w.IgnoredPaths()
+	if len(paths) != 1 || paths[0] != filepath.Join(testDir, "file.txt") {
+		t.Errorf("expected ignored paths to be [%s], got %v",
+			filepath.Join(testDir, "file.txt"), paths)
+	}
+
+	patterns := w.IgnoredPatterns()
+	if len(patterns) != 2 || patterns[0] != "*_2.txt" || patterns[1] != "testDirTwo" {
+		t.Errorf("expected ignored patterns to be [*_2.txt testDirTwo], got %v", patterns)
+	}
+
+	// The patterns of matchers and exclude globs are returned too, but not
+	// those of matchers from elsewhere, which aren't known.
+	w.AddIgnoreMatcher(RegexIgnoreMatcher(regexp.MustCompile(`\.log$`), false))
+	w.AddIgnoreMatcher(GitignoreMatcher(testDir, "# comment", "build/", "!keep.log"))
+	w.AddIgnoreMatcher(ignoreAll{})
+	if err := w.SetGlobRules(nil, []string{"*.tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"*_2.txt", "testDirTwo", `\.log$`, "build/", "!keep.log", "*.tmp"}
+	if patterns := w.IgnoredPatterns(); strings.Join(patterns, " ") != strings.Join(want, " ") {
+		t.Errorf("expected ignored patterns to be %v, got %v", want, patterns)
+	}
+}
+
+// ignoreAll is an IgnoreMatcher that ignores everything.
+type ignoreAll struct{}
+
+func (ignoreAll) Match(path string, isDir bool) bool { return true }
+
+func TestSetAutoWatchNewDirs(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetAutoWatchNewDirs(filepath.Join(testDir, "testDirTwo")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{
+		filepath.Join(testDir, "newDir"),
+		filepath.Join(testDir, "testDirTwo", "newDir"),
+	} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Check the file list over two cycles to make sure pruned
+	// directories stay pruned.
+	for i := 0; i < 2; i++ {
+		fileList := w.retrieveFileList()
+
+		for path, expected := range map[string]bool{
+			filepath.Join(testDir, "newDir"):                           true,
+			filepath.Join(testDir, "newDir", "file.txt"):               false,
+			filepath.Join(testDir, "testDirTwo", "newDir"):             true,
+			filepath.Join(testDir, "testDirTwo", "newDir", "file.txt"): true,
+		} {
+			if _, found := fileList[path]; found != expected {
+				t.Errorf("expected %s to be listed to be %t, got %t", path, expected, found)
+			}
+		}
+
+		w.files = fileList
+	}
+
+	// Adding a pruned directory explicitly watches its contents.
+	if err := w.AddRecursive(filepath.Join(testDir, "newDir")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(testDir, "newDir", "file.txt")
+	if _, found := w.retrieveFileList()[path]; !found {
+		t.Errorf("expected %s to be listed once its directory is added", path)
+	}
+}
+
+func TestSetLagWarning(t *testing.T) {
+	w := New()
+
+	// No warnings by default.
+	for i := 0; i < 5; i++ {
+		if w.lagged(time.Second, time.Millisecond) {
+			t.Fatal("expected no lag warning by default")
+		}
+	}
+
+	w.SetLagWarning(2)
+
+	testCases := []struct {
+		elapsed  time.Duration
+		expected bool
+	}{
+		{time.Second, false},
+		{time.Microsecond, false}, // Resets the count.
+		{time.Second, false},
+		{time.Second, true},
+		{time.Second, false},
+		{time.Second, true},
+	}
+
+	for i, tc := range testCases {
+		if w.lagged(tc.elapsed, time.Millisecond) != tc.expected {
+			t.Errorf("cycle %d: expected lagged to be %t", i, tc.expected)
+		}
+	}
+}
+
+func TestNewForProject(t *testing.T) {
+	// TODO: Write tests for ignore hidden on windows.
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	for _, dir := range []string{"node_modules", "vendor"} {
+		dir = filepath.Join(testDir, dir)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "dep.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewForProject(filepath.Join(testDir, "missing")); err == nil {
+		t.Error("expected an error for a missing root")
+	}
+
+	w, err := NewForProject(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.files) != 7 {
+		t.Errorf("expected len(w.files) to be 7, got %d", len(w.files))
+	}
+
+	for _, path := range []string{"node_modules", "vendor", ".dotfile"} {
+		if _, found := w.files[filepath.Join(testDir, path)]; found {
+			t.Errorf("expected to not find %s", path)
+		}
+	}
+}
+
+func TestBasenameFilterHook(t *testing.T) {
+	hook := BasenameFilterHook("Dockerfile", "go.mod")
+
+	testCases := []struct {
+		info     os.FileInfo
+		path     string
+		expected error
+	}{
+		{&fileInfo{name: "Dockerfile"}, "/a/Dockerfile", nil},
+		{&fileInfo{name: "go.mod"}, "/a/b/go.mod", nil},
+		{&fileInfo{name: "main.go"}, "/a/main.go", ErrSkip},
+		{&fileInfo{name: "go.mod", dir: true}, "/a/go.mod", nil},
+		{&fileInfo{name: "src", dir: true}, "/a/src", nil},
+	}
+
+	for _, tc := range testCases {
+		if err := hook(tc.info, tc.path); err != tc.expected {
+			t.Errorf("expected hook(%s) to return %v, got %v", tc.path, tc.expected, err)
+		}
+	}
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+	w.SetIdleTimeout(time.Millisecond * 50)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "newfile.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	returned := make(chan error)
+	go func() {
+		returned <- w.Start(time.Millisecond * 10)
+	}()
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Create {
+			t.Errorf("expected event to be Create, got %s", event.Op)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no create event")
+	}
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Start to return after the idle timeout")
+	}
+
+	select {
+	case <-w.Closed:
+	default:
+		t.Error("expected the Closed channel to be closed")
+	}
+
+	// Close is a no-op after the watcher closed itself.
+	w.Close()
+}
+
+func TestAddRootFilterHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Only watch files directly under the root they were listed from.
+	hook := func(info os.FileInfo, fullPath, root string) error {
+		if fullPath != root && filepath.Dir(fullPath) != root {
+			return ErrSkip
+		}
+		return nil
+	}
+
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+	fileRecursive := filepath.Join(dirTwo, "file_recursive.txt")
+
+	testCases := []struct {
+		roots    []string
+		expected bool
+	}{
+		{[]string{testDir}, false},
+		{[]string{testDir, dirTwo}, true},
+	}
+
+	for _, tc := range testCases {
+		w := New()
+		w.AddRootFilterHook(hook)
+
+		for _, root := range tc.roots {
+			if err := w.AddRecursive(root); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, found := w.files[fileRecursive]; found != tc.expected {
+			t.Errorf("expected found to be %t for roots %v, got %t",
+				tc.expected, tc.roots, found)
+		}
+	}
+}
+
+func TestSetCollapseCreateWrite(t *testing.T) {
+	events := func() []Event {
+		return []Event{
+			{Op: Write, Path: "/a"},
+			{Op: Write, Path: "/b"},
+			{Op: Create, Path: "/a"},
+		}
+	}
+
+	w := New()
+
+	if filtered := w.filterEvents(events()); len(filtered) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(filtered))
+	}
+
+	w.SetCollapseCreateWrite(true)
+
+	filtered := w.filterEvents(events())
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(filtered))
+	}
+	if filtered[0].Op != Write || filtered[0].Path != "/b" {
+		t.Errorf("expected a Write event for /b, got %s %s", filtered[0].Op, filtered[0].Path)
+	}
+	if filtered[1].Op != Create || filtered[1].Path != "/a" {
+		t.Errorf("expected a Create event for /a, got %s %s", filtered[1].Op, filtered[1].Path)
+	}
+}
+
+func TestSetCollapseCreateWriteCycles(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetCollapseCreateWrite(true)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(testDir, "new.txt")
+	cycle := func() []Event {
+		files := w.retrieveFileList()
+		var events []Event
+		for _, event := range w.filterEvents(w.pollEvents(files)) {
+			if event.Path == path {
+				events = append(events, event)
+			}
+		}
+		w.files = files
+		return events
+	}
+	write := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("a", now)
+	if events := cycle(); len(events) != 1 || events[0].Op != Create {
+		t.Fatalf("expected a Create event, got %v", events)
+	}
+
+	// Writes found during the next cycle are still sent.
+	write("ab", now.Add(time.Second))
+	if events := cycle(); len(events) != 1 || events[0].Op != Write {
+		t.Errorf("expected a Write event, got %v", events)
+	}
+
+	write("abc", now.Add(2*time.Second))
+	if events := cycle(); len(events) != 1 || events[0].Op != Write {
+		t.Errorf("expected a Write event, got %v", events)
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	var fw FileWatcher = New()
+
+	if err := fw.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := fw.Start(time.Millisecond * 100); err != nil {
+			t.Error(err)
+		}
+	}()
+	fw.Wait()
+
+	if err := os.Remove(filepath.Join(testDir, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for done := false; !done; {
+		select {
+		case event := <-fw.Events():
+			done = event.Op == Remove
+		case err := <-fw.Errors():
+			t.Fatal(err)
+		case <-time.After(time.Millisecond * 250):
+			t.Fatal("received no remove event")
+		}
+	}
+
+	fw.Close()
+
+	select {
+	case <-fw.Done():
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("expected the watcher to be closed")
+	}
+}
+
+func TestChannelAccessors(t *testing.T) {
+	w := New()
+
+	if w.Events() != (<-chan Event)(w.Event) {
+		t.Error("expected Events() to return w.Event")
+	}
+	if w.Errors() != (<-chan error)(w.Error) {
+		t.Error("expected Errors() to return w.Error")
+	}
+	if w.Done() != (<-chan struct{})(w.Closed) {
+		t.Error("expected Done() to return w.Closed")
+	}
+}
+
+func TestSetPathAlias(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	canonical := filepath.Join(testDir, "file.txt")
+	alias := filepath.Join(testDir, "file.txt.tmp")
+	other := filepath.Join(testDir, "file_1.txt")
+
+	w := New()
+	if err := w.SetPathAlias(canonical, alias); err != nil {
+		t.Fatal(err)
+	}
+
+	filtered := w.filterEvents([]Event{
+		{Op: Write, Path: canonical, OldPath: canonical},
+		{Op: Write, Path: other, OldPath: other},
+		{Op: Remove, Path: alias, OldPath: alias},
+		{Op: Rename, Path: canonical, OldPath: alias},
+	})
+
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(filtered))
+	}
+	if filtered[0].Op != Write || filtered[0].Path != canonical {
+		t.Errorf("expected a Write event for %s, got %s %s", canonical, filtered[0].Op, filtered[0].Path)
+	}
+	if filtered[1].Path != other {
+		t.Errorf("expected an event for %s, got %s", other, filtered[1].Path)
+	}
+
+	// Events for an alias on its own are sent for the canonical path.
+	filtered = w.filterEvents([]Event{{Op: Create, Path: alias}})
+	if len(filtered) != 1 || filtered[0].Path != canonical {
+		t.Errorf("expected an event for %s, got %v", canonical, filtered)
+	}
+}
+
+func TestSetDistinctDirOps(t *testing.T) {
+	events := func() []Event {
+		return []Event{
+			{Op: Create, Path: "/a", FileInfo: &fileInfo{name: "a", dir: true}},
+			{Op: Create, Path: "/b", FileInfo: &fileInfo{name: "b"}},
+			{Op: Remove, Path: "/c", FileInfo: &fileInfo{name: "c", dir: true}},
+			{Op: Write, Path: "/d", FileInfo: &fileInfo{name: "d", dir: true}},
+		}
+	}
+
+	w := New()
+	for i, event := range w.filterEvents(events()) {
+		if event.Op != events()[i].Op {
+			t.Errorf("expected event %d to be %s, got %s", i, events()[i].Op, event.Op)
+		}
+	}
+
+	w.SetDistinctDirOps(true)
+	expected := []Op{DirCreate, Create, DirRemove, Write}
+	for i, event := range w.filterEvents(events()) {
+		if event.Op != expected[i] {
+			t.Errorf("expected event %d to be %s, got %s", i, expected[i], event.Op)
+		}
+	}
+}
+
+func TestSetStableDelay(t *testing.T) {
+	w := New()
+	w.SetStableDelay(time.Millisecond * 50)
+
+	info := &fileInfo{name: "a"}
+	dirInfo := &fileInfo{name: "d", dir: true}
+
+	// The Create event is held back while the file keeps changing.
+	for _, op := range []Op{Create, Write, Write} {
+		events := w.stabilize([]Event{
+			{Op: op, Path: "/a", FileInfo: info},
+			{Op: Write, Path: "/d", FileInfo: dirInfo},
+		})
+		if len(events) != 1 || events[0].Path != "/d" {
+			t.Fatalf("expected only the directory's event, got %v", events)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 60)
+
+	events := w.stabilize(nil)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Create || events[0].Path != "/a" {
+		t.Errorf("expected a Create event for /a, got %s %s", events[0].Op, events[0].Path)
+	}
+
+	// A file that's removed before it's stable causes no events.
+	w.stabilize([]Event{{Op: Create, Path: "/b", FileInfo: info}})
+	if events := w.stabilize([]Event{{Op: Remove, Path: "/b", FileInfo: info}}); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+	if len(w.unstable) != 0 {
+		t.Errorf("expected no unstable files, got %d", len(w.unstable))
+	}
+}
+
+func TestModeFilterHooks(t *testing.T) {
+	worldWritable := func(mode os.FileMode) bool {
+		return mode.Perm()&0002 != 0
+	}
+
+	hook := ModeFilterHook(worldWritable)
+	if err := hook(&fileInfo{name: "a", mode: 0777}, "/a"); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := hook(&fileInfo{name: "b", mode: 0644}, "/b"); err != ErrSkip {
+		t.Errorf("expected ErrSkip, got %v", err)
+	}
+	if err := hook(&fileInfo{name: "c", mode: os.ModeDir | 0755, dir: true}, "/c"); err != nil {
+		t.Errorf("expected nil for a directory, got %v", err)
+	}
+
+	w := New()
+	w.FilterOps(Chmod)
+	w.AddEventFilterHook(ModeEventFilterHook(worldWritable))
+
+	filtered := w.filterEvents([]Event{
+		{Op: Chmod, Path: "/a", FileInfo: &fileInfo{name: "a", mode: 0777}},
+		{Op: Chmod, Path: "/b", FileInfo: &fileInfo{name: "b", mode: 0600}},
+		{Op: Write, Path: "/c", FileInfo: &fileInfo{name: "c", mode: 0777}},
+	})
+
+	if len(filtered) != 1 || filtered[0].Path != "/a" {
+		t.Errorf("expected only the Chmod event for /a, got %v", filtered)
+	}
+}
+
+func TestWatcherAddRecursiveOverlapping(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	dirTwo := filepath.Join(testDir, "testDirTwo")
+
+	// Count how many files are listed.
+	listed := 0
+	w := New()
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		listed++
+		return nil
+	})
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if listed != 8 {
+		t.Errorf("expected 8 files to be listed, got %d", listed)
+	}
+
+	// Adding a directory that's already watched doesn't list it again.
+	if err := w.AddRecursive(dirTwo); err != nil {
+		t.Fatal(err)
+	}
+	if listed != 8 {
+		t.Errorf("expected 8 files to be listed, got %d", listed)
+	}
+
+	if len(w.WatchedFiles()) != 8 {
+		t.Errorf("expected 8 watched files, got %d", len(w.WatchedFiles()))
+	}
+	if _, found := w.names[dirTwo]; !found {
+		t.Errorf("expected w.names to contain %s", dirTwo)
+	}
+
+	listed = 0
+	if fileList := w.retrieveFileList(); len(fileList) != 8 {
+		t.Errorf("expected 8 files in the file list, got %d", len(fileList))
+	}
+	if listed != 8 {
+		t.Errorf("expected 8 files to be listed, got %d", listed)
+	}
+
+	// Once the parent is removed, the directory is still watched.
+	if err := w.RemoveRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if fileList := w.retrieveFileList(); len(fileList) != 2 {
+		t.Errorf("expected 2 files in the file list, got %d", len(fileList))
+	}
+}
+
+// fakeClock is a Clock whose time only passes when advance is called.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	c   chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), c: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c
+}
+
+func (c *fakeClock) C() <-chan time.Time {
+	return c.c
+}
+
+func (c *fakeClock) Stop() {}
+
+// advance moves the time forward by d and then ticks once.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.c <- now
+}
+
+func TestSetClock(t *testing.T) {
+	clock := newFakeClock()
+
+	w := New()
+	w.SetAllowEmpty(true)
+	w.SetClock(clock)
+	w.SetIdleTimeout(time.Hour)
+
+	returned := make(chan error)
+	go func() {
+		returned <- w.Start(time.Minute)
+	}()
+	w.Wait()
+
+	clock.advance(time.Minute * 30)
+
+	select {
+	case <-returned:
+		t.Fatal("expected Start to not return before the idle timeout")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	clock.advance(time.Minute * 31)
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Start to return after the idle timeout")
+	}
+}
+
+func TestSetWatchAccessibility(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetWatchAccessibility(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record which files are readable.
+	fileList := w.retrieveFileList()
+	w.pollEvents(fileList)
+	w.files = fileList
+
+	path := filepath.Join(testDir, "file.txt")
+	if !w.readable[path] {
+		t.Fatalf("expected %s to be readable", path)
+	}
+
+	// Pretend that the file became unreadable without a mode change.
+	w.readable[path] = false
+
+	events := w.pollEvents(w.retrieveFileList())
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Chmod || events[0].Path != path {
+		t.Errorf("expected a Chmod event for %s, got %s %s", path, events[0].Op, events[0].Path)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(w.WatchedFiles()) {
+		t.Fatalf("expected %d files in the snapshot, got %d", len(w.WatchedFiles()), len(before))
+	}
+
+	newFile := filepath.Join(testDir, "testDirTwo", "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(testDir, "file_1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(testDir, "file.txt"), filepath.Join(testDir, "file1.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The watched files are left as they were.
+	if len(w.WatchedFiles()) != len(before) {
+		t.Errorf("expected %d watched files, got %d", len(before), len(w.WatchedFiles()))
+	}
+
+	events, err := before.Diff(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[Op]string)
+	for _, event := range events {
+		if event.IsDir() {
+			continue
+		}
+		found[event.Op] = event.Path
+	}
+
+	expected := map[Op]string{
+		Create: newFile,
+		Remove: filepath.Join(testDir, "file_1.txt"),
+		Rename: filepath.Join(testDir, "file1.txt"),
+	}
+	if len(found) != len(expected) {
+		t.Errorf("expected %d file events, got %d", len(expected), len(found))
+	}
+	for op, path := range expected {
+		if found[op] != path {
+			t.Errorf("expected a %s event for %s, got %q", op, path, found[op])
+		}
+	}
+
+	if _, err := before.Diff(Snapshot{"/a": nil}); err == nil {
+		t.Error("expected an error for a snapshot without file info")
+	}
+}
+
+func TestTriggerEventWait(t *testing.T) {
+	w := New()
+	w.SetAllowEmpty(true)
+
+	// The watcher hasn't started.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := w.TriggerEventWait(ctx, Create, nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Nothing is left behind waiting for the watcher to start.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w.TriggerEventWait(ctx, Create, nil)
+	}
+	if n := runtime.NumGoroutine(); n >= before+10 {
+		t.Errorf("expected no goroutines to be left behind, got %d more", n-before)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 100); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	received := make(chan Event)
+	go func() {
+		received <- <-w.Event
+	}()
+
+	if err := w.TriggerEventWait(context.Background(), Write, nil); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-received; event.Op != Write || event.Name() != "triggered event" {
+		t.Errorf("expected a triggered Write event, got %s %s", event.Op, event.Name())
+	}
+
+	w.Close()
+
+	if err := w.TriggerEventWait(context.Background(), Write, nil); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetFollowRotation(t *testing.T) {
+	// Rotations can't be detected on windows.
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	log := filepath.Join(testDir, "file.txt")
+
+	w := New()
+	w.FilterOps(Rotated)
+	if err := w.SetFollowRotation(log); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the file.
+	if err := os.Rename(log, log+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(log, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.filterEvents(w.pollEvents(w.retrieveFileList()))
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Rotated || events[0].Path != log {
+		t.Errorf("expected a Rotated event for %s, got %s %s", log, events[0].Op, events[0].Path)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+	w.Wait()
+
+	path := filepath.Join(testDir, "testDirTwo", "newfile.txt")
+	if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The directory's write event is skipped.
+	event, err := w.WaitFor(ctx, func(e Event) bool {
+		return e.Op == Create
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Path != path {
+		t.Errorf("expected a Create event for %s, got %s", path, event.Path)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err = w.WaitFor(ctx, func(e Event) bool {
+		return false
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAddPaths(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	dirThree := filepath.Join(testDir, "testDirTwo", "testDirThree")
+	if err := os.Mkdir(dirThree, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fileThree := filepath.Join(dirThree, "file.txt")
+	if err := ioutil.WriteFile(fileThree, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		spec     WatchSpec
+		expected int
+	}{
+		{WatchSpec{Path: testDir}, 7},
+		{WatchSpec{Path: testDir, Recursive: true, Depth: 1}, 7},
+		{WatchSpec{Path: testDir, Recursive: true, Depth: 2}, 9},
+		{WatchSpec{Path: testDir, Recursive: true}, 10},
+	}
+
+	for _, tc := range testCases {
+		w := New()
+		if err := w.AddPaths(tc.spec); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.files) != tc.expected {
+			t.Errorf("expected len(w.files) to be %d for %+v, got %d",
+				tc.expected, tc.spec, len(w.files))
+		}
+		if fileList := w.retrieveFileList(); len(fileList) != tc.expected {
+			t.Errorf("expected len(fileList) to be %d for %+v, got %d",
+				tc.expected, tc.spec, len(fileList))
+		}
+	}
+
+	// Mixed roots in one call.
+	w := New()
+	err := w.AddPaths(
+		WatchSpec{Path: filepath.Join(testDir, "file.txt")},
+		WatchSpec{Path: dirThree, Recursive: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.files) != 3 {
+		t.Errorf("expected len(w.files) to be 3, got %d", len(w.files))
+	}
+
+	if err := w.AddPaths(WatchSpec{Path: "-"}, WatchSpec{Path: testDir}); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+}
+
+func TestSetTrackOffsets(t *testing.T) {
+	now := time.Now()
+	old := Snapshot{
+		"/a": &fileInfo{name: "a", size: 10, modTime: now},
+		"/b": &fileInfo{name: "b", size: 10, modTime: now},
+	}
+	changed := Snapshot{
+		"/a": &fileInfo{name: "a", size: 15, modTime: now.Add(time.Second)},
+		"/b": &fileInfo{name: "b", size: 5, modTime: now.Add(time.Second)},
+	}
+
+	d := detector{trackOffsets: true}
+	events := d.diff(old, changed)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if events[0].Path != "/a" || events[0].Offset != 10 || events[0].Truncated {
+		t.Errorf("expected /a to have offset 10 and not be truncated, got %s %d %t",
+			events[0].Path, events[0].Offset, events[0].Truncated)
+	}
+	if events[1].Path != "/b" || events[1].Offset != 0 || !events[1].Truncated {
+		t.Errorf("expected /b to have offset 0 and be truncated, got %s %d %t",
+			events[1].Path, events[1].Offset, events[1].Truncated)
+	}
+
+	// Offsets aren't set by default.
+	events, err := old.Diff(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Offset != 0 {
+		t.Errorf("expected offset to be 0, got %d", events[0].Offset)
+	}
+}
+
+func TestIgnoreMatchers(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	p := func(path string) string {
+		return filepath.Join(root, filepath.FromSlash(path))
+	}
+
+	glob, err := GlobIgnoreMatcher("*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GlobIgnoreMatcher("["); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	gitignore := GitignoreMatcher(root,
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/docs/*.html",
+		"**/cache",
+		"lib/**/gen",
+	)
+
+	testCases := []struct {
+		m        IgnoreMatcher
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{glob, p("a.tmp"), false, true},
+		{glob, p("a/b.tmp"), false, true},
+		{glob, p("a.txt"), false, false},
+
+		{RegexIgnoreMatcher(regexp.MustCompile(`^_`), false), p("a/_b"), false, true},
+		{RegexIgnoreMatcher(regexp.MustCompile(`^_`), true), p("a/_b"), false, false},
+
+		{gitignore, p("a.log"), false, true},
+		{gitignore, p("a/b/c.log"), false, true},
+		{gitignore, p("a/keep.log"), false, false},
+		{gitignore, p("build"), true, true},
+		{gitignore, p("build"), false, false},
+		{gitignore, p("build/out.o"), false, true},
+		{gitignore, p("a/build"), true, true},
+		{gitignore, p("docs/index.html"), false, true},
+		{gitignore, p("a/docs/index.html"), false, false},
+		{gitignore, p("docs/a/index.html"), false, false},
+		{gitignore, p("a/b/cache"), true, true},
+		{gitignore, p("cache"), true, true},
+		{gitignore, p("lib/gen"), true, true},
+		{gitignore, p("lib/a/b/gen/x.go"), false, true},
+		{gitignore, p("main.go"), false, false},
+		{gitignore, filepath.FromSlash("/other/a.log"), false, false},
+	}
+
+	for _, tc := range testCases {
+		if matched := tc.m.Match(tc.path, tc.isDir); matched != tc.expected {
+			t.Errorf("expected Match(%s, %t) to be %t, got %t",
+				tc.path, tc.isDir, tc.expected, matched)
+		}
+	}
+}
+
+func TestAddIgnoreMatcher(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	gitignore := filepath.Join(testDir, ".gitignore")
+	if err := ioutil.WriteFile(gitignore, []byte("*_2.txt\ntestDirTwo/\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadGitignore(gitignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.AddIgnoreMatcher(m)
+
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// testDir, .gitignore, .dotfile, file.txt, file_1.txt and file_3.txt.
+	if len(w.files) != 6 {
+		t.Errorf("expected len(w.files) to be 6, got %d", len(w.files))
+	}
+
+	// Files that are created later are ignored too.
+	newFile := filepath.Join(testDir, "new_2.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.retrieveFileList()[newFile]; found {
+		t.Errorf("expected to not find %s", newFile)
+	}
+}
+
+func TestSetMaxEventsPerCycle(t *testing.T) {
+	w := New()
+	w.SetMaxEventsPerCycle(2)
+
+	cycles := [][]Event{
+		{{Op: Create, Path: "/a"}, {Op: Create, Path: "/b"}, {Op: Create, Path: "/c"}},
+		{{Op: Write, Path: "/d"}},
+		nil,
+		nil,
+	}
+	expected := [][]string{
+		{"/a", "/b"},
+		{"/c", "/d"},
+		nil,
+		nil,
+	}
+
+	for i, events := range cycles {
+		sent := w.deferEvents(events)
+		if len(sent) != len(expected[i]) {
+			t.Fatalf("cycle %d: expected %d events, got %d", i, len(expected[i]), len(sent))
+		}
+		for j, event := range sent {
+			if event.Path != expected[i][j] {
+				t.Errorf("cycle %d: expected event %d to be for %s, got %s",
+					i, j, expected[i][j], event.Path)
+			}
+		}
+	}
+}
+
+func TestEventChanged(t *testing.T) {
+	now := time.Now()
+	old := Snapshot{
+		"/a": &fileInfo{name: "a", size: 1, mode: 0644, modTime: now},
+		"/b": &fileInfo{name: "b", size: 1, mode: 0644, modTime: now},
+	}
+	changed := Snapshot{
+		"/a": &fileInfo{name: "a", size: 2, mode: 0644, modTime: now.Add(time.Second)},
+		"/b": &fileInfo{name: "b", size: 1, mode: 0600, modTime: now},
+	}
+
+	events, err := old.Diff(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	expected := []Changes{
+		{ModTime: true, Size: true},
+		{Mode: true},
+	}
+	for i, event := range events {
+		if event.Changed != expected[i] {
+			t.Errorf("expected %s event for %s to have changes %+v, got %+v",
+				event.Op, event.Path, expected[i], event.Changed)
+		}
+	}
+}
+
+func TestAddShallow(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddShallow(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.files) != 7 {
+		t.Errorf("expected len(w.files) to be 7, got %d", len(w.files))
+	}
+
+	// Write to a file and create another one.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(testDir, "file.txt"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(testDir, "newfile.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.filterEvents(w.pollEvents(w.retrieveFileList()))
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Create || events[0].Path != newFile {
+		t.Errorf("expected a Create event for %s, got %s %s", newFile, events[0].Op, events[0].Path)
+	}
+
+	if err := w.Remove(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.shallow) != 0 {
+		t.Errorf("expected len(w.shallow) to be 0, got %d", len(w.shallow))
+	}
+}
+
+func TestSetEventTransformer(t *testing.T) {
+	w := New()
+	w.SetEventTransformer(func(e Event) (Event, bool) {
+		if e.Op == Remove {
+			return e, false
+		}
+		e.Path = strings.ToUpper(e.Path)
+		return e, true
+	})
+
+	filtered := w.filterEvents([]Event{
+		{Op: Create, Path: "/a"},
+		{Op: Remove, Path: "/b"},
+		{Op: Write, Path: "/c"},
+	})
+
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(filtered))
+	}
+	if filtered[0].Path != "/A" || filtered[1].Path != "/C" {
+		t.Errorf("expected transformed paths /A and /C, got %s and %s",
+			filtered[0].Path, filtered[1].Path)
+	}
+}
+
+func TestSetScanConcurrency(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	newWatcher := func(n int) *Watcher {
+		w := New()
+		w.SetScanConcurrency(n)
+		if err := w.Add(filepath.Join(testDir, "file.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add(testDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddRecursive(filepath.Join(testDir, "testDirTwo")); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	serial := newWatcher(1).retrieveFileList()
+	parallel := newWatcher(4).retrieveFileList()
+
+	if len(parallel) != len(serial) {
+		t.Fatalf("expected %d files, got %d", len(serial), len(parallel))
+	}
+	for path := range serial {
+		if _, found := parallel[path]; !found {
+			t.Errorf("expected %s to be listed", path)
+		}
+	}
+
+	w := newWatcher(4)
+	if err := ioutil.WriteFile(filepath.Join(testDir, "testDirTwo", "new.txt"),
+		[]byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events := w.pollEvents(w.retrieveFileList())
+	if len(events) != 2 || events[0].Op != Write || events[1].Op != Create {
+		t.Errorf("expected a Write and a Create event, got %v", events)
+	}
+
+	// The directories of a single tree are spread across the goroutines.
+	for _, dir := range []string{"a", "b", filepath.Join("b", "c"), filepath.Join("b", "c", "d")} {
+		if err := os.MkdirAll(filepath.Join(testDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(testDir, dir, "file.txt"), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := func(n int) map[string]os.FileInfo {
+		w := New()
+		w.SetScanConcurrency(n)
+		if err := w.AddRecursive(testDir); err != nil {
+			t.Fatal(err)
+		}
+		return w.retrieveFileList()
+	}
+	serial, parallel = tree(1), tree(4)
+	if len(parallel) != len(serial) {
+		t.Fatalf("expected %d files, got %d", len(serial), len(parallel))
+	}
+	for path := range serial {
+		if _, found := parallel[path]; !found {
+			t.Errorf("expected %s to be listed", path)
+		}
+	}
+}
+
+func TestFilterOpsAllOps(t *testing.T) {
+	events := []Event{
+		{Op: Create, Path: "/a"},
+		{Op: Write, Path: "/b"},
+		{Op: Remove, Path: "/c"},
+	}
+
+	w := New()
+
+	w.FilterOps(Write)
+	if filtered := w.filterEvents(events); len(filtered) != 1 {
+		t.Errorf("expected 1 event, got %d", len(filtered))
+	}
+
+	w.FilterOps(Write, AllOps)
+	if filtered := w.filterEvents(events); len(filtered) != 3 {
+		t.Errorf("expected 3 events, got %d", len(filtered))
+	}
+
+	w.SuppressAllOps()
+	if filtered := w.filterEvents(events); len(filtered) != 0 {
+		t.Errorf("expected 0 events, got %d", len(filtered))
+	}
+
+	w.FilterOps()
+	if filtered := w.filterEvents(events); len(filtered) != 3 {
+		t.Errorf("expected 3 events, got %d", len(filtered))
+	}
+}
+
+func TestRemoveRecursiveExcludes(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	testDirTwo := filepath.Join(testDir, "testDirTwo")
+	if err := w.RemoveRecursive(testDirTwo); err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := filepath.Join(testDirTwo, "new.txt")
+	if err := ioutil.WriteFile(newFile, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := w.retrieveFileList()
+	for _, path := range []string{testDirTwo, newFile} {
+		if _, found := files[path]; found {
+			t.Errorf("expected %s to stay removed", path)
+		}
+	}
+
+	// Adding it again stops excluding it.
+	if err := w.AddRecursive(testDirTwo); err != nil {
+		t.Fatal(err)
+	}
+	files = w.retrieveFileList()
+	if _, found := files[newFile]; !found {
+		t.Errorf("expected %s to be watched again", newFile)
+	}
+}
+
+func TestSetTriggerMode(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetTriggerMode(Level)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "file.txt")
+	files := w.retrieveFileList()
+	w.track(Event{Op: Write, Path: path, FileInfo: files[path]})
+
+	for i := 0; i < 2; i++ {
+		events := w.remind(nil, files)
+		if len(events) != 1 || events[0].Op != Write || events[0].Path != path {
+			t.Fatalf("expected a Write event for %s, got %v", path, events)
+		}
+	}
+
+	w.Ack(Event{Op: Write, Path: path})
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Errorf("expected no events after Ack, got %v", events)
+	}
+
+	w.track(Event{Op: Create, Path: path})
+	w.track(Event{Op: Remove, Path: path})
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Errorf("expected no events after Remove, got %v", events)
+	}
+
+	w.SetTriggerMode(Edge)
+	w.track(Event{Op: Write, Path: path})
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Errorf("expected no events in Edge mode, got %v", events)
+	}
+}
+
+func TestSetAckTimeout(t *testing.T) {
+	clock := newFakeClock()
+
+	w := New()
+	w.SetClock(clock)
+	w.SetAckTimeout(time.Minute)
+
+	sent := Event{Op: Create, Path: "/fake/path"}
+	w.track(sent)
+	files := map[string]os.FileInfo{sent.Path: nil}
+
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Fatalf("expected no events before the timeout, got %v", events)
+	}
+
+	clock.mu.Lock()
+	clock.now = clock.now.Add(time.Minute)
+	clock.mu.Unlock()
+
+	events := w.remind(nil, files)
+	if len(events) != 1 || events[0] != sent {
+		t.Fatalf("expected %v to be sent again, got %v", sent, events)
+	}
+
+	// Sending it again restarts the timeout.
+	w.track(events[0])
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Errorf("expected no events after sending again, got %v", events)
+	}
+
+	w.Ack(sent)
+	clock.mu.Lock()
+	clock.now = clock.now.Add(time.Minute)
+	clock.mu.Unlock()
+	if events := w.remind(nil, files); len(events) != 0 {
+		t.Errorf("expected no events after Ack, got %v", events)
+	}
+}
+
+func TestAddWithInterval(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	clock := newFakeClock()
+
+	w := New()
+	w.SetClock(clock)
+
+	if err := w.AddWithInterval(testDir, 0); err != ErrDurationTooShort {
+		t.Errorf("expected error to be ErrDurationTooShort, got %v", err)
+	}
+
+	path := filepath.Join(testDir, "file.txt")
+	if err := w.AddWithInterval(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	w.retrieveFileList()
+
+	if err := ioutil.WriteFile(path, []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := w.retrieveFileList()[path].Size(); size != 0 {
+		t.Errorf("expected %s not to be checked yet, got size %d", path, size)
+	}
+
+	clock.mu.Lock()
+	clock.now = clock.now.Add(time.Minute)
+	clock.mu.Unlock()
+
+	if size := w.retrieveFileList()[path].Size(); size != 5 {
+		t.Errorf("expected %s to be checked, got size %d", path, size)
+	}
+}
+
+func TestSetWatchSetDeltaThreshold(t *testing.T) {
+	w := New()
+
+	if w.massChange(0, 100) {
+		t.Error("expected no mass change without a threshold")
+	}
+
+	w.SetWatchSetDeltaThreshold(2)
+
+	testCases := []struct {
+		before, after int
+		expected      bool
+	}{
+		{10, 12, false},
+		{10, 13, true},
+		{10, 8, false},
+		{10, 7, true},
+	}
+
+	for _, tc := range testCases {
+		if got := w.massChange(tc.before, tc.after); got != tc.expected {
+			t.Errorf("expected massChange(%d, %d) to be %t, got %t",
+				tc.before, tc.after, tc.expected, got)
+		}
+	}
+}
+
+func TestEventMarshalJSON(t *testing.T) {
+	e := Event{Op: Rename, Path: "/fake/new\xffname", OldPath: "/fake/old"}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Op           string
+		Path         string
+		PathBytes    []byte
+		OldPath      string
+		OldPathBytes []byte
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Op != "RENAME" {
+		t.Errorf("expected op to be RENAME, got %s", decoded.Op)
+	}
+	if decoded.Path != "/fake/new�name" {
+		t.Errorf("expected path to be /fake/new�name, got %s", decoded.Path)
+	}
+	if string(decoded.PathBytes) != e.Path {
+		t.Errorf("expected path bytes to be %q, got %q", e.Path, decoded.PathBytes)
+	}
+	if decoded.OldPath != e.OldPath || decoded.OldPathBytes != nil {
+		t.Errorf("expected old path to be %s without bytes, got %s and %q",
+			e.OldPath, decoded.OldPath, decoded.OldPathBytes)
+	}
+}
+
+func TestInvalidUTF8FileName(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file names must be valid UTF-8 on " + runtime.GOOS)
+	}
+
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "bad\xffname")
+	if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, event := range w.pollEvents(w.retrieveFileList()) {
+		if event.Op == Create && event.Path == path {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a Create event for %q", path)
+	}
+}
+
+func TestSetStrictChmod(t *testing.T) {
+	now := time.Now()
+	old := map[string]os.FileInfo{
+		"/a": &fileInfo{name: "a", mode: 0644, modTime: now},
+		"/b": &fileInfo{name: "b", mode: 0644, modTime: now},
+	}
+	changed := map[string]os.FileInfo{
+		"/a": &fileInfo{name: "a", mode: 0644 | os.ModeSetuid, modTime: now},
+		"/b": &fileInfo{name: "b", mode: 0600, modTime: now},
+	}
+
+	w := New()
+	w.files = old
+	if events := w.pollEvents(changed); len(events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(events))
+	}
+
+	w.SetStrictChmod(true)
+	events := w.pollEvents(changed)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Chmod || events[0].Path != "/b" {
+		t.Errorf("expected a Chmod event for /b, got %s for %s",
+			events[0].Op, events[0].Path)
+	}
+}
+
+func TestWatchedFilesFunc(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := w.WatchedFilesFunc(func(path string, info os.FileInfo) bool {
+		return info.IsDir()
+	})
+
+	expected := []string{testDir, filepath.Join(testDir, "testDirTwo")}
+	if len(dirs) != len(expected) {
+		t.Errorf("expected %d directories, got %d", len(expected), len(dirs))
+	}
+	for _, path := range expected {
+		if _, found := dirs[path]; !found {
+			t.Errorf("expected %s to be returned", path)
+		}
+	}
+}
+
+func TestWaitForPath(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	path := filepath.Join(testDir, "ready")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if err := WaitForPath(ctx, path, time.Millisecond*10); err != context.DeadlineExceeded {
+		t.Errorf("expected error to be context.DeadlineExceeded, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := WaitForPath(ctx, path, time.Millisecond*10); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// It returns straight away when path already exists.
+	if err := WaitForPath(ctx, path, time.Millisecond*10); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestSetMoveSizeTolerance(t *testing.T) {
+	now := time.Now()
+	old := map[string]os.FileInfo{
+		"/dir/a": &fileInfo{name: "a", size: 100, mode: 0644, modTime: now},
+	}
+	moved := map[string]os.FileInfo{
+		"/dir/b": &fileInfo{name: "b", size: 110, mode: 0644, modTime: now.Add(time.Second)},
+	}
+
+	w := New()
+	w.files = old
+	events := w.pollEvents(moved)
+	if len(events) != 2 || events[0].Op != Create || events[1].Op != Remove {
+		t.Errorf("expected a Create and a Remove event, got %v", events)
+	}
+
+	w.SetMoveSizeTolerance(5)
+	if events := w.pollEvents(moved); len(events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(events))
+	}
+
+	w.SetMoveSizeTolerance(10)
+	events = w.pollEvents(moved)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Rename || events[0].OldPath != "/dir/a" || events[0].Path != "/dir/b" {
+		t.Errorf("expected a Rename event from /dir/a to /dir/b, got %s from %s to %s",
+			events[0].Op, events[0].OldPath, events[0].Path)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	w := New()
+
+	w.queue = []Event{{Op: Create, Path: "/a"}, {Op: Create, Path: "/b"}}
+	w.deferred = []Event{{Op: Create, Path: "/c"}}
+
+	sent := make(chan error)
+	go func() {
+		sent <- w.sendQueued()
+	}()
+
+	// Give sendQueued time to start sending the first event.
+	time.Sleep(time.Millisecond * 50)
+
+	if n := w.Drain(); n != 3 {
+		t.Errorf("expected 3 events to be discarded, got %d", n)
+	}
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("expected sendQueued to return nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sendQueued didn't return after Drain")
+	}
+
+	if pending := w.Pending(); pending != 0 {
+		t.Errorf("expected no pending events, got %d", pending)
+	}
+}
+
+func TestSetPathRewrite(t *testing.T) {
+	w := New()
+	w.SetPathRewrite(regexp.MustCompile(`^/resolved/target`), "/link")
+
+	filtered := w.filterEvents([]Event{
+		{Op: Rename, Path: "/resolved/target/b", OldPath: "/resolved/target/a"},
+		{Op: Create, Path: "/other/c"},
+	})
+
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(filtered))
+	}
+	if filtered[0].Path != "/link/b" || filtered[0].OldPath != "/link/a" {
+		t.Errorf("expected paths /link/b and /link/a, got %s and %s",
+			filtered[0].Path, filtered[0].OldPath)
+	}
+	if filtered[1].Path != "/other/c" {
+		t.Errorf("expected path /other/c, got %s", filtered[1].Path)
+	}
+}
+
+func TestSetIgnorePreexisting(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetIgnorePreexisting(true)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed after being added, but before starting.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "before.txt"),
+		[]byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+	w.Wait()
+
+	after := filepath.Join(testDir, "after.txt")
+	if err := ioutil.WriteFile(after, []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case event := <-w.Event:
+			if event.Op != Create {
+				continue
+			}
+			if event.Path != after {
+				t.Fatalf("expected a Create event for %s, got one for %s", after, event.Path)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("received no Create event")
+		}
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	err := &MultiError{errs: []error{ErrSkip}}
+	if err.Error() != ErrSkip.Error() {
+		t.Errorf("expected %q, got %q", ErrSkip.Error(), err.Error())
+	}
+
+	err = &MultiError{errs: []error{ErrSkip, ErrClosed}}
+	expected := "2 errors occurred: " + ErrSkip.Error() + "; " + ErrClosed.Error()
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	if errs := err.Errors(); len(errs) != 2 || errs[0] != ErrSkip || errs[1] != ErrClosed {
+		t.Errorf("expected errors to be %v and %v, got %v", ErrSkip, ErrClosed, errs)
+	}
+}
+
+func TestSetSkipPermissionErrors(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	locked := filepath.Join(testDir, "locked")
+	if err := os.Mkdir(locked, 0000); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+	if _, err := ioutil.ReadDir(locked); err == nil {
+		t.Skip("permissions aren't enforced for this user")
+	}
+
+	w := New()
+	if err := w.AddRecursive(testDir); !os.IsPermission(err) {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+
+	w = New()
+	w.SetSkipPermissionErrors(true)
+	err := w.AddRecursive(testDir)
+	multi, ok := err.(*MultiError)
+	if !ok || len(multi.Errors()) != 1 {
+		t.Fatalf("expected a MultiError with 1 error, got %v", err)
+	}
+
+	files := w.WatchedFiles()
+	for _, path := range []string{locked, filepath.Join(testDir, "file.txt")} {
+		if _, found := files[path]; !found {
+			t.Errorf("expected %s to be watched", path)
+		}
+	}
+
+	// The errors of every root replaced at once are returned.
+	other := filepath.Join(testDir, "testDirTwo", "locked")
+	if err := os.Mkdir(other, 0000); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(other, 0755)
+	err = w.ReplaceRoots(
+		WatchSpec{Path: locked, Recursive: true},
+		WatchSpec{Path: filepath.Join(testDir, "testDirTwo"), Recursive: true},
+	)
+	if multi, ok := err.(*MultiError); !ok || len(multi.Errors()) != 2 {
+		t.Errorf("expected a MultiError with 2 errors, got %v", err)
+	}
+}
+
+func TestSetStopAfterFirstEvent(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetStopAfterFirstEvent(true)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two events are found during the first cycle.
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name),
+			[]byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- w.Start(time.Millisecond * 10)
+	}()
+
+	select {
+	case <-w.Event:
+	case <-time.After(time.Second):
+		t.Fatal("received no event")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected Start to return nil, got %v", err)
+		}
+	case event := <-w.Event:
+		t.Errorf("expected no more events, got %v", event)
+	case <-time.After(time.Second):
+		t.Fatal("Start didn't return")
+	}
+
+	select {
+	case <-w.Closed:
+	default:
+		t.Error("expected w.Closed to be closed")
+	}
+}
+
+func TestSetTickHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var cycles []uint64
+	w.SetTickHook(func(cycle uint64) {
+		cycles = append(cycles, cycle)
+		if cycle == 3 {
+			w.Close()
+		}
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- w.Start(time.Millisecond * 10)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start didn't return")
+	}
+
+	if len(cycles) != 3 || cycles[0] != 1 || cycles[2] != 3 {
+		t.Errorf("expected cycles 1 to 3, got %v", cycles)
+	}
+}
+
+func TestSetMaxEventDepth(t *testing.T) {
+	w := New()
+	w.names[filepath.FromSlash("/root")] = true
+	w.names[filepath.FromSlash("/root/a/b")] = false
+	w.SetMaxEventDepth(2)
+
+	var events []Event
+	for _, path := range []string{"/root", "/root/a", "/root/a/x", "/root/c/d/e", "/root/a/b/c", "/other/a/b/c"} {
+		events = append(events, Event{Op: Create, Path: filepath.FromSlash(path)})
+	}
+	filtered := w.filterEvents(events)
+
+	expected := []string{"/root", "/root/a", "/root/a/x", "/root/a/b/c", "/other/a/b/c"}
+	if len(filtered) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(filtered))
+	}
+	for i, event := range filtered {
+		if event.Path != filepath.FromSlash(expected[i]) {
+			t.Errorf("expected event for %s, got one for %s", expected[i], event.Path)
+		}
+	}
+}
+
+func TestLastEvent(t *testing.T) {
+	abs := func(path string) string {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b, c := abs("a"), abs("b"), abs("c")
+
+	w := New()
+	w.remember(Event{Op: Create, Path: a})
+	if _, found := w.LastEvent(a); found {
+		t.Error("expected no events to be remembered by default")
+	}
+
+	w.SetLastEventCache(2)
+	w.remember(Event{Op: Create, Path: a})
+	w.remember(Event{Op: Create, Path: b})
+	w.remember(Event{Op: Write, Path: a})
+	w.remember(Event{Op: Create, Path: c})
+
+	if event, found := w.LastEvent("a"); !found || event.Op != Write {
+		t.Errorf("expected the last event for a to be a Write event, got %v", event.Op)
+	}
+	if _, found := w.LastEvent("b"); found {
+		t.Error("expected the event for b to be forgotten")
+	}
+	if _, found := w.LastEvent("c"); !found {
+		t.Error("expected the event for c to be remembered")
+	}
+}
+
+func TestContentTypeFilterHook(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	png := filepath.Join(testDir, "image.dat")
+	if err := ioutil.WriteFile(png, []byte("\x89PNG\x0D\x0A\x1A\x0A"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.AddFilterHook(ContentTypeFilterHook("image/"))
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	files := w.WatchedFiles()
+	for _, path := range []string{testDir, filepath.Join(testDir, "testDirTwo"), png} {
+		if _, found := files[path]; !found {
+			t.Errorf("expected %s to be watched", path)
+		}
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 files to be watched, got %d", len(files))
+	}
+
+	// Changing the file's size makes it sniffed again.
+	if err := ioutil.WriteFile(png, []byte("plain text"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.retrieveFileList()[png]; found {
+		t.Errorf("expected %s not to be watched", png)
+	}
+
+	// So does changing its modification time.
+	if err := ioutil.WriteFile(png, []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(png, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.retrieveFileList()[png]; !found {
+		t.Errorf("expected %s to be watched", png)
+	}
+}
+
+func TestContentTypeFilterHookForgets(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	hook := ContentTypeFilterHook("text/")
+	path := filepath.Join(testDir, "file.txt")
+	other := filepath.Join(testDir, "file_1.txt")
+	infos := make(map[string]os.FileInfo)
+	for _, p := range []string{path, other} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hook(info, p); err != nil {
+			t.Fatalf("expected %s to be accepted, got %v", p, err)
+		}
+		infos[p] = info
+	}
+
+	// Once a file is seen removed, a new file at its path is sniffed
+	// again, even if it looks the same.
+	if err := ioutil.WriteFile(path, []byte{0}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook(infos[path], path); err != nil {
+		t.Errorf("expected %s to still be remembered as text, got %v", path, err)
+	}
+	forgetSniffed([]Event{{Op: Remove, Path: path, FileInfo: infos[path]}})
+	if err := hook(infos[path], path); err != ErrSkip {
+		t.Errorf("expected %s to be skipped once it's binary, got %v", path, err)
+	}
+
+	// So is one whose removal is only seen as a write of its directory.
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	dirInfo, err := os.Stat(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgetSniffed([]Event{{Op: Write, Path: testDir, FileInfo: dirInfo}})
+	if err := ioutil.WriteFile(other, []byte{0}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := hook(infos[other], other); err != ErrSkip {
+		t.Errorf("expected %s to be skipped once it's binary, got %v", other, err)
+	}
+}
+
+func TestWatcherStartWhenNothingWatched(t *testing.T) {
+	w := New()
+
+	if err := w.Start(time.Millisecond * 100); err != ErrNothingWatched {
+		t.Fatalf("expected ErrNothingWatched error, got %v", err)
+	}
+}
+
+func TestWithInterval(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Create)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.SetInterval(0); err != ErrDurationTooShort {
+		t.Errorf("expected error to be ErrDurationTooShort, got %v", err)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+	w.Wait()
+
+	path := filepath.Join(testDir, "bulk.txt")
+	err := w.WithInterval(time.Hour, func() {
+		// Let any cycle that's already running finish.
+		time.Sleep(time.Millisecond * 50)
+
+		if err := ioutil.WriteFile(path, []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+		if pending := w.Pending(); pending != 0 {
+			t.Errorf("expected no events while the interval is an hour, got %d", pending)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		if event.Path != path {
+			t.Errorf("expected a Create event for %s, got one for %s", path, event.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no event after the interval was restored")
+	}
+}
+
+func TestSetEventSink(t *testing.T) {
+	w := New()
+
+	sink := make(chan Event, 2)
+	w.SetEventSink(sink)
+
+	w.queue = []Event{{Op: Create, Path: "/a"}, {Op: Create, Path: "/b"}}
+	if err := w.sendQueued(); err != nil {
+		t.Fatalf("expected sendQueued to return nil, got %v", err)
+	}
+	if len(sink) != 2 {
+		t.Fatalf("expected 2 events on the sink, got %d", len(sink))
+	}
+
+	// Once the sink is unset, the Event channel is used again.
+	w.SetEventSink(nil)
+	w.queue = []Event{{Op: Create, Path: "/c"}}
+	go w.sendQueued()
+
+	select {
+	case event := <-w.Event:
+		if event.Path != "/c" {
+			t.Errorf("expected event for /c, got one for %s", event.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no event from Event channel")
+	}
+}
+
+func TestDirectoryRename(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.FilterOps(Rename, Move, Create, Remove)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDir := filepath.Join(testDir, "testDirTwo")
+	newDir := filepath.Join(testDir, "testDirThree")
+	if err := os.Rename(oldDir, newDir); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.filterEvents(w.pollEvents(w.retrieveFileList()))
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d: %v", len(events), events)
+	}
+	if events[0].Op != Rename || events[0].OldPath != oldDir || events[0].Path != newDir {
+		t.Errorf("expected a Rename event from %s to %s, got %s from %s to %s",
+			oldDir, newDir, events[0].Op, events[0].OldPath, events[0].Path)
+	}
+}
+
+func TestSetIgnoreRoots(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	child := filepath.Join(root, "file.txt")
+
+	w := New()
+	w.names[root] = true
+	w.SetIgnoreRoots(true)
+
+	filtered := w.filterEvents([]Event{
+		{Op: Chmod, Path: root},
+		{Op: Write, Path: child},
+	})
+	if len(filtered) != 1 || filtered[0].Path != child {
+		t.Errorf("expected a single event for %s, got %v", child, filtered)
+	}
+}
+
+func TestClearFilterHooks(t *testing.T) {
+	w := New()
+	if n := w.FilterHookCount(); n != 0 {
+		t.Errorf("expected 0 filter hooks, got %d", n)
+	}
+
+	w.AddFilterHook(NoDirectoryFilterHook())
+	w.AddRootFilterHook(func(info os.FileInfo, fullPath, root string) error {
+		return nil
+	})
+	if n := w.FilterHookCount(); n != 2 {
+		t.Errorf("expected 2 filter hooks, got %d", n)
+	}
+
+	w.ClearFilterHooks()
+	if n := w.FilterHookCount(); n != 0 {
+		t.Errorf("expected 0 filter hooks, got %d", n)
+	}
+	if w.rootHooks {
+		t.Error("expected rootHooks to be false")
+	}
+}
+
+func TestSetSlashPaths(t *testing.T) {
+	path := filepath.Join("a", "b", "c")
+	oldPath := filepath.Join("a", "b", "d")
+
+	w := New()
+	w.SetSlashPaths(true)
+
+	filtered := w.filterEvents([]Event{{Op: Rename, Path: path, OldPath: oldPath}})
+	if len(filtered) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(filtered))
+	}
+	if filtered[0].Path != "a/b/c" || filtered[0].OldPath != "a/b/d" {
+		t.Errorf("expected paths a/b/c and a/b/d, got %s and %s",
+			filtered[0].Path, filtered[0].OldPath)
+	}
+}
+
+func TestSetModTimeResolution(t *testing.T) {
+	modTime := time.Date(2019, 8, 17, 0, 0, 0, 0, time.UTC)
+	old := map[string]os.FileInfo{
+		"/a": &fileInfo{name: "a", modTime: modTime.Add(time.Microsecond)},
+		"/b": &fileInfo{name: "b", modTime: modTime},
+	}
+	changed := map[string]os.FileInfo{
+		"/a": &fileInfo{name: "a", modTime: modTime.Add(time.Microsecond * 2)},
+		"/b": &fileInfo{name: "b", modTime: modTime.Add(time.Millisecond * 2)},
+	}
+
+	w := New()
+	w.files = old
+	if events := w.pollEvents(changed); len(events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(events))
+	}
+
+	w.SetModTimeResolution(time.Millisecond)
+	events := w.pollEvents(changed)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].Op != Write || events[0].Path != "/b" {
+		t.Errorf("expected a Write event for /b, got %s for %s", events[0].Op, events[0].Path)
+	}
+}
+
+func TestSetWatchDirEmptiness(t *testing.T) {
+	dir, file := filepath.FromSlash("/d"), filepath.FromSlash("/d/a")
+	empty := map[string]os.FileInfo{
+		dir: &fileInfo{name: "d", dir: true},
+	}
+	full := map[string]os.FileInfo{
+		dir:  &fileInfo{name: "d", dir: true},
+		file: &fileInfo{name: "a"},
+	}
+
+	w := New()
+	w.SetWatchDirEmptiness(true)
+	w.files = empty
+	if events := w.pollEvents(empty); len(events) != 0 {
+		t.Errorf("expected 0 events, got %d", len(events))
+	}
+
+	hasOp := func(events []Event, op Op) bool {
+		for _, event := range events {
+			if event.Op == op && event.Path == dir {
+				return true
+			}
+		}
+		return false
+	}
+
+	events := w.pollEvents(full)
+	if len(events) != 2 || !hasOp(events, DirNonEmpty) {
+		t.Errorf("expected a Create and a DirNonEmpty event, got %v", events)
+	}
+
+	w.files = full
+	events = w.pollEvents(empty)
+	if len(events) != 2 || !hasOp(events, DirEmpty) {
+		t.Errorf("expected a Remove and a DirEmpty event, got %v", events)
+	}
+}
+
+func TestSetMaxRunTime(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetMaxRunTime(time.Millisecond * 50)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	returned := make(chan error)
+	go func() {
+		returned <- w.Start(time.Millisecond * 10)
+	}()
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Start to return after the maximum run time")
+	}
+
+	select {
+	case <-w.Closed:
+	default:
+		t.Error("expected the Closed channel to be closed")
+	}
+}
+
+// tickerClock is a Clock whose tickers only tick when told to, each on its
+// own channel, so that they can be told apart by their durations.
+type tickerClock struct {
+	mu      sync.Mutex
+	tickers map[time.Duration]chanTicker
+}
+
+type chanTicker chan time.Time
+
+func (t chanTicker) C() <-chan time.Time { return t }
+func (t chanTicker) Stop()               {}
+
+func (c *tickerClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *tickerClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tickers == nil {
+		c.tickers = make(map[time.Duration]chanTicker)
+	}
+	c.tickers[d] = make(chanTicker)
+	return c.tickers[d]
+}
+
+// tick makes the ticker for d tick once, and reports whether it was
+// received.
+func (c *tickerClock) tick(d time.Duration) bool {
+	c.mu.Lock()
+	ticker := c.tickers[d]
+	c.mu.Unlock()
+	select {
+	case ticker <- time.Now():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestSetMaxRunTimeWhileSending(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	clock := &tickerClock{}
+	w := New()
+	w.SetClock(clock)
+	w.SetMaxRunTime(time.Minute)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	returned := make(chan error)
+	go func() {
+		returned <- w.Start(time.Second)
+	}()
+	w.Wait()
+
+	// Nothing receives the Create event, so Start is stuck sending it
+	// when the max run time passes.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !clock.tick(time.Second) {
+		t.Fatal("expected the watcher to wait for the next cycle")
+	}
+	if !clock.tick(time.Minute) {
+		t.Fatal("expected the watcher to wait for the max run time while sending")
+	}
+
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Start to return once the max run time passed")
+	}
+}
+
+func TestEventEqual(t *testing.T) {
+	event := Event{Op: Move, Path: "/b", OldPath: "/a"}
+	if !event.Equal(Event{Op: Move, Path: "/b", OldPath: "/a", Offset: 1}) {
+		t.Error("expected events with the same op and paths to be equal")
+	}
+	if event.Equal(Event{Op: Rename, Path: "/b", OldPath: "/a"}) {
+		t.Error("expected events with different ops not to be equal")
+	}
+	if event.Equal(Event{Op: Move, Path: "/b", OldPath: "/c"}) {
+		t.Error("expected events with different old paths not to be equal")
+	}
+}
+
+func TestDedupeEvents(t *testing.T) {
+	events := DedupeEvents([]Event{
+		{Op: Write, Path: "/a"},
+		{Op: Chmod, Path: "/b"},
+		{Op: Create, Path: "/a"},
+		{Op: Write, Path: "/a"},
+		{Op: Chmod, Path: "/b"},
+		{Op: Remove, Path: "/c"},
+	})
+
+	expected := []Event{
+		{Op: Create, Path: "/a"},
+		{Op: Chmod, Path: "/b"},
+		{Op: Remove, Path: "/c"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i := range expected {
+		if !events[i].Equal(expected[i]) {
+			t.Errorf("expected event %d to be %s for %s, got %s for %s",
+				i, expected[i].Op, expected[i].Path, events[i].Op, events[i].Path)
+		}
+	}
+}
+
+func TestAddFilterOpsHook(t *testing.T) {
+	calls := make(map[string]int)
+	w := New()
+	w.AddFilterOpsHook(func(info os.FileInfo, fullPath string) (bool, []Op) {
+		calls[fullPath]++
+		switch filepath.Ext(fullPath) {
+		case ".csv":
+			return true, []Op{Create}
+		case ".txt":
+			return true, nil
+		}
+		return false, nil
+	})
+
+	if watched, _, _ := w.judge(&fileInfo{name: "a.log"}, "a.log", &listing{}, nil); watched {
+		t.Error("expected a.log not to be listed")
+	}
+	if watched, _, _ := w.judge(&fileInfo{name: "a.csv"}, "a.csv", &listing{}, nil); !watched {
+		t.Error("expected a.csv to be listed")
+	}
+	if watched, _, _ := w.judge(&fileInfo{name: "a.txt"}, "a.txt", &listing{}, nil); !watched {
+		t.Error("expected a.txt to be listed")
+	}
+
+	filtered := w.filterEvents([]Event{
+		{Op: Create, Path: "a.csv", FileInfo: &fileInfo{name: "a.csv"}},
+		{Op: Write, Path: "a.csv", FileInfo: &fileInfo{name: "a.csv"}},
+		{Op: Write, Path: "a.txt", FileInfo: &fileInfo{name: "a.txt"}},
+	})
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(filtered))
+	}
+	if filtered[0].Op != Create || filtered[0].Path != "a.csv" {
+		t.Errorf("expected a Create event for a.csv, got %s for %s", filtered[0].Op, filtered[0].Path)
+	}
+	if filtered[1].Op != Write || filtered[1].Path != "a.txt" {
+		t.Errorf("expected a Write event for a.txt, got %s for %s", filtered[1].Op, filtered[1].Path)
+	}
+	for path, n := range calls {
+		if n != 1 {
+			t.Errorf("expected the hook to be called once for %s, got %d calls", path, n)
+		}
+	}
+
+	// A removed file's ops are forgotten.
+	w.filterEvents([]Event{{Op: Remove, Path: "a.csv"}})
+	if filtered := w.filterEvents([]Event{{Op: Write, Path: "a.csv"}}); len(filtered) != 1 {
+		t.Errorf("expected the ops of a.csv to be forgotten once it's removed, got %v", filtered)
+	}
+}
+
+func TestSetEventCountTrigger(t *testing.T) {
+	path, err := filepath.Abs("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	if err := w.SetEventCountTrigger(path, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []int
+	for i := 1; i <= 6; i++ {
+		filtered := w.filterEvents([]Event{
+			{Op: Write, Path: path},
+			{Op: Chmod, Path: path},
+		})
+		if len(filtered) == 2 {
+			sent = append(sent, i)
+		} else if len(filtered) != 1 || filtered[0].Op != Chmod {
+			t.Fatalf("expected only a Chmod event in cycle %d, got %v", i, filtered)
+		}
+	}
+	if len(sent) != 2 || sent[0] != 3 || sent[1] != 6 {
+		t.Errorf("expected Write events to be sent in cycles 3 and 6, got %v", sent)
+	}
+
+	if err := w.SetEventCountTrigger(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if filtered := w.filterEvents([]Event{{Op: Write, Path: path}}); len(filtered) != 1 {
+		t.Errorf("expected 1 event, got %d", len(filtered))
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	var mu sync.Mutex
+	var changes []string
+
+	w := New()
+	w.OnStateChange(func(old, new WatcherState) {
+		mu.Lock()
+		changes = append(changes, old.String()+" -> "+new.String())
+		mu.Unlock()
+	})
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if state := w.State(); state != Idle {
+		t.Errorf("expected state to be %s, got %s", Idle, state)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	w.Wait()
+
+	w.Pause()
+	if state := w.State(); state != Paused {
+		t.Errorf("expected state to be %s, got %s", Paused, state)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, "newfile.txt"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Event:
+		t.Fatalf("expected no events while paused, got %s", event)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	w.Resume()
+
+	select {
+	case event := <-w.Event:
+		if event.Op != Create && event.Op != Write {
+			t.Errorf("expected a Create or Write event, got %s", event.Op)
+		}
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("received no events after resuming")
+	}
+
+	w.Close()
+
+	expected := []string{
+		"IDLE -> RUNNING",
+		"RUNNING -> PAUSED",
+		"PAUSED -> RUNNING",
+		"RUNNING -> CLOSED",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(changes, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected state changes %v, got %v", expected, changes)
+	}
+}
+
+func TestSuppressNextWrite(t *testing.T) {
+	path, err := filepath.Abs("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	if err := w.SuppressNextWrite(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if filtered := w.filterEvents([]Event{{Op: Chmod, Path: path}}); len(filtered) != 1 {
+		t.Errorf("expected 1 event, got %d", len(filtered))
+	}
+	if filtered := w.filterEvents([]Event{{Op: Write, Path: path}}); len(filtered) != 0 {
+		t.Errorf("expected 0 events, got %d", len(filtered))
+	}
+	if filtered := w.filterEvents([]Event{{Op: Write, Path: path}}); len(filtered) != 1 {
+		t.Errorf("expected 1 event, got %d", len(filtered))
+	}
+}
+
+func TestAddMatching(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.AddMatching(testDir, "[", false); err != filepath.ErrBadPattern {
+		t.Errorf("expected error to be ErrBadPattern, got %v", err)
+	}
+	if err := w.AddMatching(testDir, "file_*.txt", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// testDir, file_1.txt, file_2.txt, file_3.txt, testDirTwo and
+	// testDirTwo/file_recursive.txt.
+	if n := len(w.WatchedFiles()); n != 6 {
+		t.Errorf("expected 6 watched files, got %d", n)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	w.Wait()
+	defer w.Close()
+
+	for _, name := range []string{"file_4.txt", "other.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events []Event
+	timeout := time.After(time.Millisecond * 250)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case <-timeout:
+			done = true
+		}
+	}
+
+	path := filepath.Join(testDir, "file_4.txt")
+	if len(events) != 1 || events[0].Op != Create || events[0].Path != path {
+		t.Errorf("expected a single Create event for %s, got %v", path, events)
+	}
+}
+
+func TestStartErrorsIs(t *testing.T) {
+	w := New()
+	w.SetAllowEmpty(true)
+
+	if err := w.Start(0); !errors.Is(err, ErrDurationTooShort) {
+		t.Errorf("expected Start to return ErrDurationTooShort, got %v", err)
+	}
+	if err := w.SetInterval(0); !errors.Is(err, ErrDurationTooShort) {
+		t.Errorf("expected SetInterval to return ErrDurationTooShort, got %v", err)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	w.Wait()
+	defer w.Close()
+
+	err := w.Start(time.Millisecond * 10)
+	if !errors.Is(err, ErrWatcherRunning) {
+		t.Errorf("expected Start to return ErrWatcherRunning, got %v", err)
+	}
+	if errors.Is(err, ErrDurationTooShort) {
+		t.Error("expected ErrWatcherRunning not to be ErrDurationTooShort")
+	}
+}
+
+func TestSetEmitRemoveOnClose(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetEmitRemoveOnClose(true)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	watched := len(w.WatchedFiles())
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	w.Wait()
+	w.Close()
+
+	var events []Event
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			events = append(events, event)
+		case <-w.Closed:
+			done = true
+		case <-timeout:
+			t.Fatal("expected the Closed channel to be closed")
+		}
+	}
+
+	if len(events) != watched {
+		t.Fatalf("expected %d events, got %d", watched, len(events))
+	}
+	seen := make(map[string]struct{})
+	for _, event := range events {
+		if event.Op != Remove {
+			t.Errorf("expected event to be Remove, got %s", event.Op)
+		}
+		if _, found := seen[filepath.Dir(event.Path)]; found {
+			t.Errorf("expected %s to be removed before its directory", event.Path)
+		}
+		seen[event.Path] = struct{}{}
+	}
+	if last := events[len(events)-1].Path; last != testDir {
+		t.Errorf("expected the last event to be for %s, got %s", testDir, last)
+	}
+}
+
+func TestEmitRemoveOnCloseFiltered(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	dir := filepath.Join(root, "dir")
+	file := filepath.Join(dir, "file.txt")
+
+	w := New()
+	w.SetEmitRemoveOnClose(true)
+	w.SetIgnoreRoots(true)
+	w.SetRemoveOrder(ParentsFirst)
+	w.SetPathRewrite(regexp.MustCompile(`^`+regexp.QuoteMeta(root)), "/mnt")
+	w.names[root] = true
+	w.files = map[string]os.FileInfo{
+		root: &fileInfo{name: "project", dir: true},
+		dir:  &fileInfo{name: "dir", dir: true},
+		file: &fileInfo{name: "file.txt"},
+	}
+	w.running = true
+	w.release()
+
+	expected := []Event{
+		{Op: Remove, Path: filepath.FromSlash("/mnt/dir")},
+		{Op: Remove, Path: filepath.FromSlash("/mnt/dir/file.txt")},
+	}
+	if len(w.closing) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), w.closing)
+	}
+	for i := range expected {
+		if w.closing[i].Path != expected[i].Path || w.closing[i].Root != root {
+			t.Errorf("expected event %d to be for %s below %s, got %s below %s",
+				i, expected[i].Path, root, w.closing[i].Path, w.closing[i].Root)
+		}
+	}
+}
+
+func TestEventRoot(t *testing.T) {
+	outer := filepath.FromSlash("/project")
+	inner := filepath.FromSlash("/project/module")
+
+	w := New()
+	w.names[outer] = true
+	w.names[inner] = true
+
+	filtered := w.filterEvents([]Event{
+		{Op: Write, Path: filepath.Join(outer, "file.txt")},
+		{Op: Write, Path: filepath.Join(inner, "file.txt")},
+		{Op: Chmod, Path: inner},
+		{Op: Write, Path: filepath.FromSlash("/projects/file.txt")},
+	})
+
+	expected := []string{outer, inner, inner, ""}
+	if len(filtered) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(filtered))
+	}
+	for i, root := range expected {
+		if filtered[i].Root != root {
+			t.Errorf("expected the root of %s to be %q, got %q", filtered[i].Path, root, filtered[i].Root)
+		}
+	}
+}
+
+func TestSetCompactInterval(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetCompactInterval(time.Hour)
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	gone := filepath.Join(testDir, "gone.txt")
+	kept := filepath.Join(testDir, "file.txt")
+	w.unacked[gone] = unackedEvent{event: Event{Op: Write, Path: gone}}
+	w.unacked[kept] = unackedEvent{event: Event{Op: Write, Path: kept}}
+	w.files[filepath.Join(testDir, "missing.txt")] = &fileInfo{name: "missing.txt"}
+
+	if missing := w.compact(); missing != 1 {
+		t.Errorf("expected 1 missing file, got %d", missing)
+	}
+	if _, found := w.unacked[gone]; found {
+		t.Errorf("expected the event for %s to be left out", gone)
+	}
+	if _, found := w.unacked[kept]; !found {
+		t.Errorf("expected the event for %s to be kept", kept)
+	}
+}
+
+func TestSetCompactState(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetCompactState(true)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	w.files = w.retrieveFileList()
+	for path, info := range w.files {
+		if _, ok := info.(*compactInfo); !ok {
+			t.Errorf("expected the info of %s to be compacted", path)
+		}
+	}
+	stat, err := os.Lstat(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, known := device(w.files[testDir])
+	if expected, expectedKnown := device(stat); dev != expected || known != expectedKnown {
+		t.Errorf("expected the device of %s to be kept, got %d", testDir, dev)
+	}
+
+	oldPath := filepath.Join(testDir, "file.txt")
+	path := filepath.Join(testDir, "renamed.txt")
+	if err := os.Rename(oldPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	var renamed bool
+	for _, event := range w.pollEvents(w.retrieveFileList()) {
+		if (event.Op == Rename || event.Op == Move) && event.OldPath == oldPath && event.Path == path {
+			renamed = true
+		}
+	}
+	if !renamed {
+		t.Errorf("expected %s to be renamed to %s", oldPath, path)
+	}
+}
+
+func TestSetActiveWindow(t *testing.T) {
+	clock := newFakeClock()
+	setTime := func(hour int) {
+		clock.mu.Lock()
+		clock.now = time.Date(2019, 8, 17, hour, 0, 0, 0, time.Local)
+		clock.mu.Unlock()
+	}
+
+	w := New()
+	w.SetClock(clock)
+	w.SetActiveWindow(time.Hour*9, time.Hour*17)
+
+	old := &fileInfo{name: "a", modTime: time.Unix(1, 0)}
+	recreated := &fileInfo{name: "a", modTime: time.Unix(2, 0)}
+	created := &fileInfo{name: "b", modTime: time.Unix(2, 0)}
+	w.files = map[string]os.FileInfo{"/a": old}
+
+	// /a is removed and created again, and /b is created and removed again
+	// while the window is closed.
+	setTime(8)
+	closed := []struct {
+		events []Event
+		files  map[string]os.FileInfo
+	}{
+		{[]Event{{Op: Remove, Path: "/a"}}, map[string]os.FileInfo{}},
+		{[]Event{{Op: Create, Path: "/a"}, {Op: Create, Path: "/b"}}, map[string]os.FileInfo{"/a": recreated, "/b": created}},
+		{[]Event{{Op: Remove, Path: "/b"}}, map[string]os.FileInfo{"/a": recreated}},
+	}
+	for _, c := range closed {
+		if events := w.window(c.events, c.files); len(events) != 0 {
+			t.Errorf("expected 0 events, got %d", len(events))
+		}
+		w.files = c.files
+	}
+
+	setTime(9)
+	events := w.window([]Event{{Op: Write, Path: "/c"}}, w.files)
+	if len(events) != 1 || events[0].Op != Write || events[0].Path != "/a" {
+		t.Fatalf("expected only a Write event for /a, got %v", events)
+	}
+	if events := w.window([]Event{{Op: Write, Path: "/c"}}, w.files); len(events) != 1 || events[0].Path != "/c" {
+		t.Errorf("expected events to be sent once the window is open, got %v", events)
+	}
+
+	// Windows can span midnight.
+	w.SetActiveWindow(time.Hour*22, time.Hour*6)
+	setTime(23)
+	if !w.active(clock.Now()) {
+		t.Error("expected 23:00 to be within the window")
+	}
+	setTime(12)
+	if w.active(clock.Now()) {
+		t.Error("expected 12:00 to be outside of the window")
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	if _, err := NewWithConfig(Config{Roots: []string{testDir}}); err != ErrDurationTooShort {
+		t.Errorf("expected error to be ErrDurationTooShort, got %v", err)
+	}
+	if _, err := NewWithConfig(Config{Interval: time.Millisecond}); err != ErrNothingWatched {
+		t.Errorf("expected error to be ErrNothingWatched, got %v", err)
+	}
+	_, err := NewWithConfig(Config{
+		Interval:    time.Millisecond,
+		Roots:       []string{testDir},
+		IgnoreGlobs: []string{"["},
+	})
+	if err != filepath.ErrBadPattern {
+		t.Errorf("expected error to be ErrBadPattern, got %v", err)
+	}
+
+	w, err := NewWithConfig(Config{
+		Interval:     time.Millisecond * 10,
+		Roots:        []string{testDir},
+		Recursive:    true,
+		IgnoreHidden: true,
+		IgnoreGlobs:  []string{"file_*.txt"},
+		FilterOps:    []Op{Create},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := w.Interval(); d != time.Millisecond*10 {
+		t.Errorf("expected interval to be 10ms, got %s", d)
+	}
+
+	// testDir, file.txt and testDirTwo.
+	if n := len(w.WatchedFiles()); n != 3 {
+		t.Errorf("expected 3 watched files, got %d", n)
+	}
+	if _, found := w.ops[Create]; !found || len(w.ops) != 1 {
+		t.Errorf("expected only Create events to be sent, got %v", w.ops)
+	}
+
+	// Starting it with 0 uses the configured interval.
+	clock := newFakeClock()
+	w.SetClock(clock)
+	go w.Start(0)
+	defer w.Close()
+	w.Wait()
+	if d := w.Interval(); d != time.Millisecond*10 {
+		t.Errorf("expected the watcher to run every 10ms, got %s", d)
+	}
+	if err := New().Start(0); err != ErrDurationTooShort {
+		t.Errorf("expected error to be ErrDurationTooShort, got %v", err)
+	}
+}
+
+func TestSetStaleDeadline(t *testing.T) {
+	path, err := filepath.Abs("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	advance := func(d time.Duration) {
+		clock.mu.Lock()
+		clock.now = clock.now.Add(d)
+		clock.mu.Unlock()
+	}
+
+	w := New()
+	w.SetClock(clock)
+	if err := w.SetStaleDeadline(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	advance(time.Second * 50)
+	w.meetDeadlines([]Event{{Op: Write, Path: path}})
+	advance(time.Second * 50)
+	if events := w.staleEvents(); len(events) != 0 {
+		t.Errorf("expected 0 events, got %d", len(events))
+	}
+
+	advance(time.Second * 10)
+	events := w.staleEvents()
+	if len(events) != 1 || events[0].Op != Stale || events[0].Path != path {
+		t.Fatalf("expected a Stale event for %s, got %v", path, events)
+	}
+
+	// Only one event is sent until the path is written to again.
+	advance(time.Minute)
+	if events := w.staleEvents(); len(events) != 0 {
+		t.Errorf("expected 0 events, got %d", len(events))
+	}
+	w.meetDeadlines([]Event{{Op: Write, Path: path}})
+	advance(time.Minute)
+	if events := w.staleEvents(); len(events) != 1 {
+		t.Errorf("expected 1 event, got %d", len(events))
+	}
+}
+
+func TestReplaceRoots(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	otherDir := filepath.Join(testDir, "..", filepath.Base(testDir)+"_other")
+	if err := os.Mkdir(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+	if err := ioutil.WriteFile(filepath.Join(otherDir, "new.txt"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	w.running = true
+
+	err := w.ReplaceRoots(WatchSpec{Path: filepath.Join(testDir, "missing")})
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+	if n := len(w.WatchedFiles()); n != 8 {
+		t.Errorf("expected 8 watched files, got %d", n)
+	}
+
+	err = w.ReplaceRoots(
+		WatchSpec{Path: filepath.Join(testDir, "testDirTwo"), Recursive: true},
+		WatchSpec{Path: otherDir},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files outside of testDirTwo are removed and the ones in
+	// otherDir are created.
+	ops := make(map[Op]int)
+	for _, event := range w.deferred {
+		ops[event.Op]++
+	}
+	if ops[Create] != 2 || ops[Remove] != 6 || len(w.deferred) != 8 {
+		t.Errorf("expected 2 Create and 6 Remove events, got %v", w.deferred)
+	}
+	if n := len(w.WatchedFiles()); n != 4 {
+		t.Errorf("expected 4 watched files, got %d", n)
+	}
+
+	// Directories that were pruned are listed again once they're replaced.
+	pruned := filepath.Join(testDir, "testDirTwo")
+	w.pruned[pruned] = struct{}{}
+	if err := w.ReplaceRoots(WatchSpec{Path: testDir, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.WatchedFiles()[filepath.Join(pruned, "file_recursive.txt")]; !found {
+		t.Errorf("expected the files in %s to be watched", pruned)
+	}
+}
+
+func TestExplainPath(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	var buf bytes.Buffer
+	w := New()
+	w.SetLogger(log.New(&buf, "", 0))
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		return nil
+	})
+	w.AddFilterHook(func(info os.FileInfo, fullPath string) error {
+		if info.Name() == "file_1.txt" {
+			return ErrSkip
+		}
+		return nil
+	})
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejections are only logged while explaining.
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be logged while listing, got %q", buf.String())
+	}
+
+	rejected := filepath.Join(testDir, "file_1.txt")
+	decisions := w.ExplainPath(rejected)
+	if !strings.Contains(buf.String(), rejected+" rejected by hook #2") {
+		t.Errorf("expected the rejection of %s to be logged, got %q", rejected, buf.String())
+	}
+	expected := []string{
+		rejected + " is below " + testDir,
+		rejected + " accepted by hook #1",
+		rejected + " rejected by hook #2",
+		"not watched",
+	}
+	if strings.Join(decisions, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected decisions %q, got %q", expected, decisions)
+	}
+
+	decisions = w.ExplainPath(filepath.Join(testDir, "testDirTwo", "file_recursive.txt"))
+	if last := decisions[len(decisions)-1]; last != "watched" {
+		t.Errorf("expected the last decision to be watched, got %q", last)
+	}
+}
+
+func TestExplainPathKeepsHookState(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	ops := []Op{Create}
+	w := New()
+	w.AddFilterOpsHook(func(info os.FileInfo, fullPath string) (bool, []Op) {
+		return true, ops
+	})
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// What the hook returns while explaining isn't kept.
+	path := filepath.Join(testDir, "file.txt")
+	ops = nil
+	if decisions := w.ExplainPath(path); decisions[len(decisions)-1] != "watched" {
+		t.Errorf("expected %s to be watched, got %q", path, decisions)
+	}
+	if filtered := w.filterEvents([]Event{{Op: Write, Path: path}}); len(filtered) != 0 {
+		t.Errorf("expected the Write event to still be dropped, got %v", filtered)
+	}
+}
+
+func TestExplainPathListing(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	recursive := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	w := New()
+	if err := w.AddPaths(WatchSpec{Path: testDir, Recursive: true, Depth: 1}); err != nil {
+		t.Fatal(err)
+	}
+	decisions := w.ExplainPath(recursive)
+	expected := filepath.Join(testDir, "testDirTwo") + " is at the depth limit of 1 below " + testDir
+	if !strings.Contains(strings.Join(decisions, "\n"), expected) || decisions[len(decisions)-1] != "not watched" {
+		t.Errorf("expected %q and not watched, got %q", expected, decisions)
+	}
+
+	w = New()
+	w.SetDirGate(".processed")
+	if err := ioutil.WriteFile(filepath.Join(testDir, "testDirTwo", ".processed"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	decisions = w.ExplainPath(recursive)
+	expected = filepath.Join(testDir, "testDirTwo") + " contains .processed"
+	if !strings.Contains(strings.Join(decisions, "\n"), expected) || decisions[len(decisions)-1] != "not watched" {
+		t.Errorf("expected %q and not watched, got %q", expected, decisions)
+	}
+	if _, found := w.WatchedFiles()[recursive]; found {
+		t.Errorf("expected %s not to be watched", recursive)
+	}
+
+	w = New()
+	if err := w.SetAutoWatchNewDirs(filepath.Join(testDir, "testDirTwo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(testDir, "created")
+	if err := os.Mkdir(created, 0755); err != nil {
+		t.Fatal(err)
+	}
+	inside := filepath.Join(created, "file.txt")
+	if err := ioutil.WriteFile(inside, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	decisions = w.ExplainPath(inside)
+	expected = created + " is a new directory that isn't auto-watched"
+	if !strings.Contains(strings.Join(decisions, "\n"), expected) || decisions[len(decisions)-1] != "not watched" {
+		t.Errorf("expected %q and not watched, got %q", expected, decisions)
+	}
+	if last := w.ExplainPath(recursive); last[len(last)-1] != "watched" {
+		t.Errorf("expected %s to be watched, got %q", recursive, last)
+	}
+}
+
+func TestSetGlobRules(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.SetGlobRules([]string{"["}, nil); err != filepath.ErrBadPattern {
+		t.Errorf("expected error to be ErrBadPattern, got %v", err)
+	}
+	if err := w.SetGlobRules([]string{"*.txt"}, []string{"file_1.txt", "testDirTwo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// testDir, file.txt, file_2.txt and file_3.txt.
+	if n := len(w.WatchedFiles()); n != 4 {
+		t.Errorf("expected 4 watched files, got %v", w.WatchedFiles())
+	}
+	for _, name := range []string{".dotfile", "file_1.txt", "testDirTwo"} {
+		if _, found := w.files[filepath.Join(testDir, name)]; found {
+			t.Errorf("expected %s not to be watched", name)
+		}
+	}
+
+	// Newly created files follow the rules too.
+	for _, name := range []string{"new.txt", "new.log"} {
+		if err := ioutil.WriteFile(filepath.Join(testDir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileList := w.retrieveFileList()
+	if _, found := fileList[filepath.Join(testDir, "new.txt")]; !found {
+		t.Error("expected new.txt to be watched")
+	}
+	if _, found := fileList[filepath.Join(testDir, "new.log")]; found {
+		t.Error("expected new.log not to be watched")
+	}
+}
+
+func TestAddNewSubdirectory(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	w.Wait()
+	defer w.Close()
+
+	dir := filepath.Join(testDir, "newdir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory that it's in is written to as well.
+	timeout := time.After(time.Millisecond * 250)
+	for created := false; !created; {
+		select {
+		case event := <-w.Event:
+			created = event.Op == Create && event.Path == dir && event.IsDir()
+			if !created && event.Path != testDir {
+				t.Fatalf("expected a Create event for the directory %s, got %s", dir, event)
+			}
+		case <-timeout:
+			t.Fatal("received no create event")
+		}
+	}
+
+	// The new directory's contents aren't watched.
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	timeout = time.After(time.Millisecond * 100)
+	for done := false; !done; {
+		select {
+		case event := <-w.Event:
+			if isUnder(event.Path, dir) {
+				t.Errorf("expected no events for the contents of %s, got %s", dir, event)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+}
+
+func TestSetIgnoreFunc(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	generated := func(path string, info os.FileInfo) bool {
+		if info.IsDir() {
+			return false
+		}
+		b, err := ioutil.ReadFile(path)
+		return err == nil && strings.HasPrefix(string(b), "GENERATED")
+	}
+	if err := ioutil.WriteFile(filepath.Join(testDir, "gen.txt"), []byte("GENERATED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetIgnoreFunc(generated)
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.files[filepath.Join(testDir, "gen.txt")]; found {
+		t.Error("expected gen.txt not to be watched")
+	}
+	if _, found := w.files[filepath.Join(testDir, "file.txt")]; !found {
+		t.Error("expected file.txt to be watched")
+	}
+
+	// Files created later are checked too.
+	if err := ioutil.WriteFile(filepath.Join(testDir, "gen_2.txt"), []byte("GENERATED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileList := w.retrieveFileList()
+	if _, found := fileList[filepath.Join(testDir, "gen_2.txt")]; found {
+		t.Error("expected gen_2.txt not to be watched")
+	}
+	if _, found := fileList[filepath.Join(testDir, "new.txt")]; !found {
+		t.Error("expected new.txt to be watched")
+	}
+}
+
+func TestSetIgnoreFuncRoots(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	var asked []string
+	w := New()
+	w.SetIgnoreFunc(func(path string, info os.FileInfo) bool {
+		asked = append(asked, path)
+		return info.IsDir()
+	})
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range asked {
+		if path == testDir {
+			t.Errorf("expected the ignore func not to be called for %s", testDir)
+		}
+	}
+	if _, found := w.files[testDir]; !found {
+		t.Errorf("expected %s to be watched", testDir)
+	}
+	if _, found := w.files[filepath.Join(testDir, "file.txt")]; !found {
+		t.Error("expected file.txt to be watched")
+	}
+	if _, found := w.files[filepath.Join(testDir, "testDirTwo")]; found {
+		t.Error("expected testDirTwo not to be watched")
+	}
+}
+
+func TestSetCoalesceByDir(t *testing.T) {
+	dir := filepath.FromSlash("/project/src")
+	other := filepath.FromSlash("/project/docs")
+	a, b, c := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go"), filepath.Join(other, "c.md")
+
+	w := New()
+	events := []Event{
+		{Op: Write, Path: dir},
+		{Op: Create, Path: a},
+		{Op: Write, Path: c},
+		{Op: Write, Path: b},
+		{Op: Chmod, Path: b},
+	}
+	if coalesced := w.coalesce(events, nil); len(coalesced) != len(events) {
+		t.Errorf("expected %d events, got %d", len(events), len(coalesced))
+	}
+
+	w.SetCoalesceByDir(true)
+	files := map[string]os.FileInfo{
+		dir:   &fileInfo{name: "src", dir: true},
+		other: &fileInfo{name: "docs", dir: true},
+	}
+	coalesced := w.coalesce(events, files)
+	if len(coalesced) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(coalesced))
+	}
+	if coalesced[0].Op != Write || coalesced[0].Path != dir {
+		t.Errorf("expected a Write event for %s, got %s for %s", dir, coalesced[0].Op, coalesced[0].Path)
+	}
+	if coalesced[0].FileInfo != files[dir] {
+		t.Errorf("expected the event to have the file info of %s", dir)
+	}
+	if children := strings.Join(coalesced[0].Children(), ","); children != a+","+b {
+		t.Errorf("expected the children to be %s and %s, got %s", a, b, children)
+	}
+	if children := coalesced[1].Children(); coalesced[1].Path != other || len(children) != 1 || children[0] != c {
+		t.Errorf("expected a Write event for %s with %s as its child, got %v", other, c, coalesced[1])
+	}
+
+	// Paths are rewritten after the events are coalesced.
+	w.SetPathRewrite(regexp.MustCompile(`^`+regexp.QuoteMeta(filepath.FromSlash("/project"))), "/repo")
+	rewritten := w.rewriteEvents(w.coalesce(events, files))
+	if len(rewritten) != 2 || rewritten[0].FileInfo != files[dir] {
+		t.Fatalf("expected 2 events with file infos, got %v", rewritten)
+	}
+	if children := rewritten[1].Children(); len(children) != 1 || !strings.HasPrefix(children[0], "/repo") {
+		t.Errorf("expected the children to be rewritten, got %v", children)
+	}
+}
+
+func TestReset(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	events, errs := w.Events(), w.Errors()
+
+	for i := 0; i < 2; i++ {
+		if err := w.Add(testDir); err != nil {
+			t.Fatal(err)
+		}
+
+		returned := make(chan error)
+		go func() {
+			returned <- w.Start(time.Millisecond * 10)
+		}()
+		w.Wait()
+
+		if err := w.Reset(); err != ErrWatcherRunning {
+			t.Errorf("expected error to be ErrWatcherRunning, got %v", err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(testDir, "new.txt"), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-events:
+		case <-time.After(time.Millisecond * 250):
+			t.Fatalf("received no events after starting %d times", i+1)
+		}
+		if err := os.Remove(filepath.Join(testDir, "new.txt")); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Close()
+		if err := <-returned; err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-w.Done():
+		default:
+			t.Error("expected the Closed channel to be closed")
+		}
+		if err := w.Start(time.Millisecond * 10); err != ErrClosed {
+			t.Errorf("expected error to be ErrClosed, got %v", err)
+		}
+
+		if err := w.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if state := w.State(); state != Idle {
+			t.Errorf("expected state to be %s, got %s", Idle, state)
+		}
+
+		// Only the Closed channel is replaced.
+		if w.Events() != events || w.Errors() != errs {
+			t.Error("expected the Event and Error channels to be kept")
+		}
+		select {
+		case <-w.Done():
+			t.Error("expected the new Closed channel to be open")
+		default:
+		}
+	}
+}
+
+func TestSetRemoveOrder(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	a := filepath.Join(testDir, "a")
+	b := filepath.Join(a, "b")
+	c := filepath.Join(b, "c")
+	file := filepath.Join(c, "file.txt")
+	if err := os.MkdirAll(c, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(a); err != nil {
+		t.Fatal(err)
+	}
+	fileList := w.retrieveFileList()
+
+	removes := func() []string {
+		var paths []string
+		for _, event := range w.pollEvents(fileList) {
+			if event.Op == Remove {
+				paths = append(paths, event.Path)
+			}
+		}
+		return paths
+	}
+
+	expected := []string{file, c, b, a}
+	if paths := removes(); strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the removes to be %v, got %v", expected, paths)
+	}
+
+	w.SetRemoveOrder(ParentsFirst)
+	expected = []string{a, b, c, file}
+	if paths := removes(); strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the removes to be %v, got %v", expected, paths)
+	}
+}
+
+func TestSetChecksumManifest(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	file := filepath.Join(testDir, "file.txt")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The SHA-256 checksum of "hello".
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+	err := w.SetChecksumManifest(map[string]string{
+		file:                                  hello,
+		filepath.Join(testDir, "file_1.txt"):  hello,
+		filepath.Join(testDir, "missing.txt"): hello,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := verifyChecksums(w.takeUnverified())
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 checksum errors, got %d", len(errs))
+	}
+	var checksumErr *ChecksumError
+	if !errors.As(errs[0], &checksumErr) || !errors.Is(errs[0], ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum error, got %v", errs[0])
+	}
+	if checksumErr.Path != filepath.Join(testDir, "file_1.txt") {
+		t.Errorf("expected the error to be for file_1.txt, got %s", checksumErr.Path)
+	}
+	if !errors.As(errs[1], &checksumErr) || checksumErr.Actual != "" {
+		t.Fatalf("expected a checksum error for missing.txt, got %v", errs[1])
+	}
+
+	// Files are only checked again once they've changed.
+	if errs := verifyChecksums(w.takeUnverified()); len(errs) != 0 {
+		t.Errorf("expected no checksum errors, got %v", errs)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	fileList := w.retrieveFileList()
+	w.invalidateChecksums(w.pollEvents(fileList))
+	w.files = fileList
+
+	errs = verifyChecksums(w.takeUnverified())
+	if len(errs) != 1 || !errors.As(errs[0], &checksumErr) || checksumErr.Path != file {
+		t.Errorf("expected a checksum error for %s, got %v", file, errs)
+	}
+
+	// Removing a file in the manifest is reported.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	fileList = w.retrieveFileList()
+	w.invalidateChecksums(w.pollEvents(fileList))
+	w.files = fileList
+
+	errs = verifyChecksums(w.takeUnverified())
+	if len(errs) != 1 || !errors.As(errs[0], &checksumErr) || checksumErr.Path != file || checksumErr.Actual != "" {
+		t.Errorf("expected a checksum error for the missing %s, got %v", file, errs)
+	}
+}
+
+func TestNextScan(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	clock := newFakeClock()
+
+	w := New()
+	w.SetClock(clock)
+
+	path := filepath.Join(testDir, "file.txt")
+	other := filepath.Join(testDir, "file_1.txt")
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWithInterval(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := w.NextScan(path); ok {
+		t.Error("expected no next scan before the watcher starts")
+	}
+
+	// Pretend that the watcher started and ran a cycle.
+	w.state = Running
+	w.interval = 25 * time.Second
+	now := clock.Now()
+	if next, ok := w.NextScan(path); !ok || !next.Equal(now) {
+		t.Errorf("expected the next scan to be at %v, got %v (%t)", now, next, ok)
+	}
+	w.files = w.retrieveFileList()
+	w.lastCycle = now
+
+	testCases := []struct {
+		path     string
+		expected time.Time
+	}{
+		{path, now.Add(75 * time.Second)},
+		{other, now.Add(25 * time.Second)},
+	}
+	for _, tc := range testCases {
+		next, ok := w.NextScan(tc.path)
+		if !ok || !next.Equal(tc.expected) {
+			t.Errorf("expected the next scan of %s to be at %v, got %v (%t)", tc.path, tc.expected, next, ok)
+		}
+	}
+
+	if _, ok := w.NextScan(filepath.Join(testDir, "missing.txt")); ok {
+		t.Error("expected no next scan for a file that isn't watched")
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestStreamTo(t *testing.T) {
+	w := New()
+
+	var buf bytes.Buffer
+	w.StreamTo(&buf, FormatJSON)
+
+	w.queue = []Event{{Op: Create, Path: "/a"}, {Op: Remove, Path: "/b"}}
+	if err := w.sendQueued(); err != nil {
+		t.Fatalf("expected sendQueued to return nil, got %v", err)
+	}
+	expected := `{"op":"CREATE","path":"/a"}` + "\n" + `{"op":"REMOVE","path":"/b"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q to be written, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	w.StreamTo(&buf, FormatText)
+	w.queue = []Event{{Op: Create, Path: "/a"}}
+	if err := w.sendQueued(); err != nil {
+		t.Fatalf("expected sendQueued to return nil, got %v", err)
+	}
+	if buf.String() != "???\n" {
+		t.Errorf("expected %q to be written, got %q", "???\n", buf.String())
+	}
+
+	// Write errors are sent on the Error channel.
+	w.StreamTo(failingWriter{}, FormatText)
+	w.queue = []Event{{Op: Create, Path: "/a"}}
+	go w.sendQueued()
+
+	select {
+	case err := <-w.Error:
+		if err == nil || err.Error() != "write failed" {
+			t.Errorf("expected the write error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("received no error from Error channel")
+	}
+}
+
+func TestSetInitialScanReport(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	if err := w.Add(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan ScanResult, 1)
+	w.SetInitialScanReport(func(result ScanResult) {
+		results <- result
+	})
+
+	go func() {
+		for {
+			select {
+			case <-w.Event:
+			case <-w.Error:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+	go w.Start(time.Millisecond * 100)
+	defer w.Close()
+
+	select {
+	case result := <-results:
+		if result.FilesWatched != 7 {
+			t.Errorf("expected 7 files to be watched, got %d", result.FilesWatched)
+		}
+		if len(result.Errors) != 1 || !os.IsNotExist(result.Errors[0]) {
+			t.Errorf("expected a not exist error, got %v", result.Errors)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the initial scan wasn't reported")
+	}
+
+	select {
+	case result := <-results:
+		t.Errorf("expected only one report, got %+v", result)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestSetAdaptiveInterval(t *testing.T) {
+	w := New()
+
+	if err := w.SetAdaptiveInterval(0, time.Second); err != ErrDurationTooShort {
+		t.Errorf("expected error to be ErrDurationTooShort, got %v", err)
+	}
+	if err := w.SetAdaptiveInterval(100*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w.interval = 100 * time.Millisecond
+
+	// The interval backs off while nothing is found.
+	for _, expected := range []time.Duration{200, 400, 800, 1000, 1000} {
+		w.adaptInterval(false)
+		if w.interval != expected*time.Millisecond {
+			t.Errorf("expected the interval to be %v, got %v", expected*time.Millisecond, w.interval)
+		}
+	}
+
+	// Start is told that the interval changed.
+	select {
+	case <-w.intervalChanged:
+	default:
+		t.Error("expected the interval change to be signaled")
+	}
+
+	// It goes straight back once something is found.
+	w.adaptInterval(true)
+	if w.interval != 100*time.Millisecond {
+		t.Errorf("expected the interval to be 100ms, got %v", w.interval)
+	}
+
+	// The interval set by WithInterval is kept while its function runs.
+	w.WithInterval(time.Minute, func() {
+		w.mu.Lock()
+		w.adaptInterval(true)
+		w.adaptInterval(false)
+		interval := w.interval
+		w.mu.Unlock()
+		if interval != time.Minute {
+			t.Errorf("expected the interval to be 1m, got %v", interval)
+		}
+	})
+	if w.interval != 100*time.Millisecond {
+		t.Errorf("expected the interval to be 100ms again, got %v", w.interval)
+	}
+}
+
+func TestEventAge(t *testing.T) {
+	clock := newFakeClock()
+	w := New()
+	w.SetClock(clock)
+
+	sink := make(chan Event, 1)
+	w.SetEventSink(sink)
+
+	w.queue = []Event{{Op: Create, Path: "/a"}}
+	if err := w.sendQueued(); err != nil {
+		t.Fatalf("expected sendQueued to return nil, got %v", err)
+	}
+	event := <-sink
+	if !event.EmittedAt.Equal(clock.Now()) {
+		t.Errorf("expected the event to be sent at %v, got %v", clock.Now(), event.EmittedAt)
+	}
+
+	event.EmittedAt = time.Now().Add(-time.Minute)
+	if age := event.Age(); age < time.Minute {
+		t.Errorf("expected the event to be at least a minute old, got %v", age)
+	}
+}
+
+func TestSetDirGate(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetDirGate(".processed")
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(testDir, "testDirTwo")
+	file := filepath.Join(dir, "file_recursive.txt")
+	marker := filepath.Join(dir, ".processed")
+	if err := ioutil.WriteFile(marker, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileList := w.retrieveFileList()
+	if _, found := fileList[file]; found {
+		t.Errorf("expected %s not to be watched while %s exists", file, marker)
+	}
+	if _, found := fileList[dir]; !found {
+		t.Errorf("expected %s to still be watched", dir)
+	}
+	for _, event := range w.pollEvents(fileList) {
+		if event.Op == Remove || event.Op == Create {
+			t.Errorf("expected no removes or creates, got %v", event)
+		}
+	}
+	w.files = fileList
+
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	fileList = w.retrieveFileList()
+	var created bool
+	for _, event := range w.pollEvents(fileList) {
+		if event.Op == Create && event.Path == file {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected a create event for %s once %s is removed", file, marker)
+	}
+}
+
+func TestSetDirGateRoot(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	if err := ioutil.WriteFile(filepath.Join(testDir, ".processed"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.SetDirGate(".processed")
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(testDir, "testDirTwo", "file_recursive.txt")
+	if _, found := w.files[file]; !found {
+		t.Errorf("expected %s to be watched although %s contains the marker", file, testDir)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	var removed bool
+	for _, event := range w.pollEvents(w.retrieveFileList()) {
+		if event.Op == Remove && event.Path == file {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Errorf("expected a remove event for %s", file)
+	}
+}
+
+func TestInitialSyncDone(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+	synced := w.InitialSyncDone()
+
+	// Files created before starting are found by the first cycle.
+	path := filepath.Join(testDir, "new.txt")
+	if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := make(chan Event, 10)
+	w.SetEventSink(sink)
+
+	go func() {
+		for {
+			select {
+			case <-w.Error:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+	go w.Start(time.Millisecond * 100)
+	defer w.Close()
+
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("the initial sync didn't finish")
+	}
+
+	var created bool
+	for len(sink) > 0 {
+		if event := <-sink; event.Op == Create && event.Path == path {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected the create event for %s to be sent first", path)
+	}
+}
+
+func TestRemindersFiltered(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	w := New()
+	w.SetTriggerMode(Level)
+	w.SetPathRewrite(regexp.MustCompile(`^`+regexp.QuoteMeta(testDir)), "/project")
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "file.txt")
+	files := w.retrieveFileList()
+	sent := w.rewriteEvents(w.selectEvents([]Event{{Op: Create, Path: path, FileInfo: files[path]}}))
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(sent))
+	}
+	w.track(sent[0])
+
+	// Reminders are filtered and rewritten like other events.
+	reminders := w.rewriteEvents(w.selectReminders(w.remind(nil, files)))
+	if len(reminders) != 1 || reminders[0].Op != Write || reminders[0].Path != sent[0].Path {
+		t.Fatalf("expected a Write event for %s, got %v", sent[0].Path, reminders)
+	}
+
+	w.FilterOps(Create)
+	if reminders := w.selectReminders(w.remind(nil, files)); len(reminders) != 0 {
+		t.Errorf("expected the Write reminders to be filtered, got %v", reminders)
+	}
+
+	// Files that aren't watched anymore are forgotten.
+	delete(files, path)
+	w.remind(nil, files)
+	if len(w.unacked) != 0 {
+		t.Errorf("expected no unacknowledged events, got %v", w.unacked)
+	}
+}
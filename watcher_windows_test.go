@@ -0,0 +1,94 @@
+// +build windows
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExtendedPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		extended string
+	}{
+		{`C:\a\b`, `\\?\C:\a\b`},
+		{`\\server\share\a`, `\\?\UNC\server\share\a`},
+		{`\\?\C:\a`, `\\?\C:\a`},
+		{`a\b`, `a\b`},
+	}
+
+	for _, tc := range testCases {
+		if extended := extendedPath(tc.path); extended != tc.extended {
+			t.Errorf("expected extendedPath(%q) to be %q, got %q", tc.path, tc.extended, extended)
+		}
+		if filepath.IsAbs(tc.path) && !strings.HasPrefix(tc.path, extendedPrefix) {
+			if clean := cleanPath(tc.extended); clean != tc.path {
+				t.Errorf("expected cleanPath(%q) to be %q, got %q", tc.extended, tc.path, clean)
+			}
+		}
+	}
+}
+
+func TestWatcherAddRecursiveLongPath(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	// Create a directory tree that's longer than MAX_PATH.
+	dir := testDir
+	for len(dir) <= 260 {
+		dir = filepath.Join(dir, strings.Repeat("d", 50))
+	}
+	if err := os.MkdirAll(extendedPath(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file.txt")
+	f, err := os.Create(extendedPath(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w := New()
+	if err := w.AddRecursive(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := w.files[file]; !found {
+		t.Errorf("expected to find %s", file)
+	}
+}
+
+func TestIgnoreHiddenFilesWindows(t *testing.T) {
+	testDir, teardown := setup(t)
+	defer teardown()
+
+	hidden := filepath.Join(testDir, "file_1.txt")
+	pointer, err := syscall.UTF16PtrFromString(hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.SetFileAttributes(pointer, syscall.FILE_ATTRIBUTE_HIDDEN); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New()
+	w.IgnoreHiddenFiles(true)
+
+	if err := w.Add(testDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.files) != 5 {
+		t.Errorf("expected len(w.files) to be 5, got %d", len(w.files))
+	}
+
+	for _, path := range []string{hidden, filepath.Join(testDir, ".dotfile")} {
+		if _, found := w.files[path]; found {
+			t.Errorf("expected to not find %s", path)
+		}
+	}
+}
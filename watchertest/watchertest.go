@@ -0,0 +1,110 @@
+// Package watchertest provides helpers for testing code that uses a watcher.
+package watchertest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appsody/watcher"
+)
+
+// CreateTempTree creates a temporary directory containing the files and
+// directories described by spec, and returns its path and a function that
+// removes it. Each key of spec is a path relative to the directory, using
+// slashes, and its value is the file's contents. Keys that end with a slash
+// are directories, and any missing parent directories are created too.
+func CreateTempTree(t testing.TB, spec map[string]string) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "watchertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resolve symlinks, such as /tmp on macOS, so that paths match
+	// the ones in events.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+
+	for name, contents := range spec {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(path, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	return dir, cleanup
+}
+
+// TouchFile creates the file at path if it doesn't exist, or otherwise
+// changes its modification time, so that a Write event is sent for it.
+func TouchFile(t testing.TB, path string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure that the modification time changes even on file systems
+	// that only store it to the second.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now()
+	if !modTime.After(info.ModTime().Add(time.Second)) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// AssertEvents receives events from w until as many as expected have been
+// received or timeout passes, and reports an error unless they have the same
+// ops and paths as expected, in the same order. An expected event's OldPath
+// is only compared if it's set. Errors received from w are reported too.
+func AssertEvents(t testing.TB, w *watcher.Watcher, expected []watcher.Event, timeout time.Duration) {
+	t.Helper()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for i, want := range expected {
+		select {
+		case got := <-w.Event:
+			if got.Op != want.Op || got.Path != want.Path ||
+				want.OldPath != "" && got.OldPath != want.OldPath {
+				t.Errorf("expected event %d to be %s %s, got %s %s",
+					i, want.Op, want.Path, got.Op, got.Path)
+			}
+		case err := <-w.Error:
+			t.Fatalf("expected event %d to be %s %s, got error %v",
+				i, want.Op, want.Path, err)
+		case <-w.Closed:
+			t.Fatalf("expected event %d to be %s %s, but the watcher closed",
+				i, want.Op, want.Path)
+		case <-timer.C:
+			t.Fatalf("expected event %d to be %s %s, but received none in %s",
+				i, want.Op, want.Path, timeout)
+		}
+	}
+}
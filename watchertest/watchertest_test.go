@@ -0,0 +1,46 @@
+package watchertest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appsody/watcher"
+)
+
+func TestAssertEvents(t *testing.T) {
+	dir, cleanup := CreateTempTree(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+		"empty/":    "",
+	})
+	defer cleanup()
+
+	w := watcher.New()
+	w.FilterOps(watcher.Create, watcher.Write)
+	if err := w.AddRecursive(dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.WatchedFiles()); n != 5 {
+		t.Errorf("expected 5 watched files, got %d", n)
+	}
+
+	go func() {
+		if err := w.Start(time.Millisecond * 10); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer w.Close()
+	w.Wait()
+
+	a := filepath.Join(dir, "a.txt")
+	TouchFile(t, a)
+	AssertEvents(t, w, []watcher.Event{{Op: watcher.Write, Path: a}}, time.Second)
+
+	c := filepath.Join(dir, "empty", "c.txt")
+	TouchFile(t, c)
+	AssertEvents(t, w, []watcher.Event{
+		{Op: watcher.Write, Path: filepath.Join(dir, "empty")},
+		{Op: watcher.Create, Path: c},
+	}, time.Second)
+}
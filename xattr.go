@@ -0,0 +1,8 @@
+// +build !darwin,!linux
+
+package watcher
+
+// readXattrs is only supported on Linux and macOS.
+func readXattrs(path string) (string, bool) {
+	return "", false
+}
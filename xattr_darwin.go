@@ -0,0 +1,50 @@
+package watcher
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// listxattr puts the names of the extended attributes of the file at path
+// in dest, each followed by a NUL, and returns their size. If dest is empty,
+// it only returns their size.
+func listxattr(path string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LISTXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(buf), uintptr(len(dest)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(size), nil
+}
+
+// getxattr puts the value of the extended attribute name of the file at
+// path in dest and returns its size. If dest is empty, it only returns its
+// size.
+func getxattr(path, name string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(buf), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(size), nil
+}
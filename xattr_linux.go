@@ -0,0 +1,17 @@
+package watcher
+
+import "syscall"
+
+// listxattr puts the names of the extended attributes of the file at path
+// in dest, each followed by a NUL, and returns their size. If dest is empty,
+// it only returns their size.
+func listxattr(path string, dest []byte) (int, error) {
+	return syscall.Listxattr(path, dest)
+}
+
+// getxattr puts the value of the extended attribute name of the file at
+// path in dest and returns its size. If dest is empty, it only returns its
+// size.
+func getxattr(path, name string, dest []byte) (int, error) {
+	return syscall.Getxattr(path, name, dest)
+}
@@ -0,0 +1,47 @@
+// +build darwin linux
+
+package watcher
+
+import (
+	"sort"
+	"strings"
+)
+
+// readXattrs returns the names and values of the extended attributes of
+// the file at path, encoded as a single string so that they can be compared.
+func readXattrs(path string) (string, bool) {
+	size, err := listxattr(path, nil)
+	if err != nil {
+		return "", false
+	}
+	if size == 0 {
+		return "", true
+	}
+	list := make([]byte, size)
+	size, err = listxattr(path, list)
+	if err != nil {
+		return "", false
+	}
+
+	names := strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00")
+	sort.Strings(names)
+
+	var attrs strings.Builder
+	for _, name := range names {
+		size, err := getxattr(path, name, nil)
+		if err != nil {
+			return "", false
+		}
+		value := make([]byte, size)
+		size, err = getxattr(path, name, value)
+		if err != nil {
+			return "", false
+		}
+
+		attrs.WriteString(name)
+		attrs.WriteByte(0)
+		attrs.Write(value[:size])
+		attrs.WriteByte(0)
+	}
+	return attrs.String(), true
+}